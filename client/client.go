@@ -3,20 +3,94 @@ package client
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/labbcb/rnnr/models"
 )
 
 const contentType = "application/json"
 
-// ListTasks retrieves tasks from server that matches worker nodes and task states.
+// Token is sent as bearer token in the Authorization header of every request if not empty.
+var Token string
+
+var httpClient = http.DefaultClient
+
+// tlsConfig is used by WebSocket connections. Default configuration is used if nil.
+var tlsConfig *tls.Config
+
+// SetTLS configures HTTPS requests.
+// caFile has PEM-encoded CA certificates trusted in addition to system ones, for servers with self-signed certificates.
+// certFile and keyFile are the client certificate and its private key for servers that authenticate users by certificates.
+// Empty files are ignored.
+func SetTLS(caFile, certFile, keyFile string) error {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("%s: no PEM-encoded certificate found", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	httpClient = &http.Client{Transport: transport}
+	tlsConfig = config
+	return nil
+}
+
+func get(u string) (*http.Response, error) {
+	return do(http.MethodGet, u, nil)
+}
+
+func post(u string, body io.Reader) (*http.Response, error) {
+	return do(http.MethodPost, u, body)
+}
+
+func do(method, u string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if Token != "" {
+		req.Header.Set("Authorization", "Bearer "+Token)
+	}
+	return httpClient.Do(req)
+}
+
+// ListTasks retrieves a page of tasks from server that matches filter.
 // Pagination is done via pageSize and pageToken parameters.
+// Server default page size is used if pageSize is zero.
+// Use the next page token of the response to get the next page, or ForEachTask to iterate over all pages.
 // view defines task fields to be returned.
 //
 // Minimal returns only task ID and state.
@@ -24,25 +98,38 @@ const contentType = "application/json"
 // Basic returns all fields except Logs.ExecutorLogs.Stdout, Logs.ExecutorLogs.Stderr, Inputs.Content and Logs.SystemLogs.
 //
 // Full returns all fields.
-func ListTasks(host string, pageSize int, pageToken string, view models.View, nodes []string, states []models.State) (*models.ListTasksResponse, error) {
+func ListTasks(host string, pageSize int, pageToken string, view models.View, filter *models.TaskFilter) (*models.ListTasksResponse, error) {
 	u, err := url.Parse(host + "/ga4gh/tes/v1/tasks")
 	if err != nil {
 		return nil, err
 	}
 
 	v := url.Values{}
-	v.Set("pageSize", fmt.Sprint(pageSize))
-	v.Set("pageToken", pageToken)
-	v.Set("view", string(view))
-	for _, state := range states {
-		v.Add("state", string(state))
+	if pageSize > 0 {
+		v.Set("page_size", fmt.Sprint(pageSize))
 	}
-	for _, node := range nodes {
-		v.Add("node", string(node))
+	if pageToken != "" {
+		v.Set("page_token", pageToken)
+	}
+	v.Set("view", string(view))
+	if filter != nil {
+		if filter.NamePrefix != "" {
+			v.Set("name_prefix", filter.NamePrefix)
+		}
+		for _, state := range filter.States {
+			v.Add("state", string(state))
+		}
+		for _, node := range filter.Nodes {
+			v.Add("node", node)
+		}
+		for key, value := range filter.Tags {
+			v.Add("tag_key", key)
+			v.Add("tag_value", value)
+		}
 	}
 	u.RawQuery = v.Encode()
 
-	resp, err := http.Get(u.String())
+	resp, err := get(u.String())
 	if err != nil {
 		return nil, err
 	}
@@ -63,6 +150,30 @@ func ListTasks(host string, pageSize int, pageToken string, view models.View, no
 	return &r, nil
 }
 
+// ForEachTask calls fn for each task that matches filter.
+// It requests one page at a time, so only pageSize tasks are kept in memory.
+// It stops at the first error returned by fn.
+func ForEachTask(host string, pageSize int, view models.View, filter *models.TaskFilter, fn func(*models.Task) error) error {
+	var pageToken string
+	for {
+		resp, err := ListTasks(host, pageSize, pageToken, view, filter)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range resp.Tasks {
+			if err := fn(t); err != nil {
+				return err
+			}
+		}
+
+		if resp.NextPageToken == "" {
+			return nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
+
 // GetTask retrieves task information given its ID.
 func GetTask(host, id string, view models.View) (*models.Task, error) {
 	v := url.Values{}
@@ -74,7 +185,7 @@ func GetTask(host, id string, view models.View) (*models.Task, error) {
 	}
 	u.RawQuery = v.Encode()
 
-	resp, err := http.Get(u.String())
+	resp, err := get(u.String())
 	if err != nil {
 		return nil, err
 	}
@@ -95,9 +206,143 @@ func GetTask(host, id string, view models.View) (*models.Task, error) {
 	return &t, nil
 }
 
+// TaskLogs copies executor logs of a task to w.
+// stream is stdout or stderr, or empty to get both interleaved.
+// If follow is true it keeps copying logs of a running task until it finishes, like docker logs --follow.
+// tail is the number of lines from the end of logs, all lines if zero.
+func TaskLogs(host, id, stream string, follow bool, tail int, w io.Writer) error {
+	v := url.Values{}
+	if stream != "" {
+		v.Set("stream", stream)
+	}
+	if follow {
+		v.Set("follow", "true")
+	}
+	if tail > 0 {
+		v.Set("tail", strconv.Itoa(tail))
+	}
+
+	u, err := url.Parse(host + "/v1/tasks/" + id + "/logs")
+	if err != nil {
+		return err
+	}
+	u.RawQuery = v.Encode()
+
+	resp, err := get(u.String())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return raiseHTTPError(resp)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Exec executes command in a running task container with a TTY, like docker exec -it.
+// Terminal input is read from stdin and output is written to stdout.
+// width and height are the initial terminal size, and the terminal is resized with messages received from resize.
+// It returns the command exit code.
+func Exec(host, id string, command []string, width, height uint32, stdin io.Reader, stdout io.Writer, resize <-chan *models.ExecMessage) (int, error) {
+	v := url.Values{"command": command}
+	if width > 0 && height > 0 {
+		v.Set("width", strconv.FormatUint(uint64(width), 10))
+		v.Set("height", strconv.FormatUint(uint64(height), 10))
+	}
+
+	u, err := url.Parse(host + "/v1/tasks/" + id + "/exec")
+	if err != nil {
+		return 0, err
+	}
+	u.RawQuery = v.Encode()
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+
+	header := http.Header{}
+	if Token != "" {
+		header.Set("Authorization", "Bearer "+Token)
+	}
+	dialer := &websocket.Dialer{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+	conn, resp, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			return 0, raiseHTTPError(resp)
+		}
+		return 0, err
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	// Only one goroutine may write messages at a time.
+	var mu sync.Mutex
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stdin.Read(buf)
+			if n > 0 {
+				mu.Lock()
+				werr := conn.WriteMessage(websocket.BinaryMessage, buf[:n])
+				mu.Unlock()
+				if werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for msg := range resize {
+			mu.Lock()
+			err := conn.WriteJSON(msg)
+			mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	exitCode := 0
+	for {
+		t, data, err := conn.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			return exitCode, nil
+		}
+		if err != nil {
+			return exitCode, err
+		}
+		switch t {
+		case websocket.BinaryMessage:
+			if _, err := stdout.Write(data); err != nil {
+				return exitCode, err
+			}
+		case websocket.TextMessage:
+			var msg models.ExecMessage
+			if err := json.Unmarshal(data, &msg); err == nil && msg.ExitCode != nil {
+				exitCode = int(*msg.ExitCode)
+			}
+		}
+	}
+}
+
 // CancelTask cancels task by its ID.
 func CancelTask(host, id string) error {
-	resp, err := http.Post(host+"/ga4gh/tes/v1/tasks/"+id+":cancel", "application/json", nil)
+	resp, err := post(host+"/ga4gh/tes/v1/tasks/"+id+":cancel", nil)
 	if err != nil {
 		return err
 	}
@@ -114,6 +359,35 @@ func CancelTask(host, id string) error {
 	return nil
 }
 
+// PurgeTasks deletes terminated tasks that ended before given time returning the number of deleted tasks.
+// If states is empty all terminated tasks are deleted.
+func PurgeTasks(host string, before time.Time, states []models.State) (int64, error) {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(&models.PurgeTasksRequest{Before: before, States: states}); err != nil {
+		return 0, fmt.Errorf("encoding purge request to json: %w", err)
+	}
+
+	resp, err := post(host+"/v1/tasks:purge", &b)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, raiseHTTPError(resp)
+	}
+
+	var r models.PurgeTasksResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return 0, err
+	}
+	return r.Deleted, nil
+}
+
 // EnableNode enables worker node at main server returning its ID.
 func EnableNode(host string, n *models.Node) (id string, err error) {
 	var b bytes.Buffer
@@ -121,7 +395,7 @@ func EnableNode(host string, n *models.Node) (id string, err error) {
 		return "", fmt.Errorf("encoding node to json: %w", err)
 	}
 
-	resp, err := http.Post(host+"/v1/nodes", contentType, &b)
+	resp, err := post(host+"/v1/nodes", &b)
 	if err != nil {
 		return "", err
 	}
@@ -151,7 +425,7 @@ func DisableNode(host, id string, cancel bool) error {
 		return fmt.Errorf("encoding cancel option to json: %w", err)
 	}
 
-	resp, err := http.Post(fmt.Sprintf("%s/v1/nodes/%s:disable", host, id), contentType, &b)
+	resp, err := post(fmt.Sprintf("%s/v1/nodes/%s:disable", host, id), &b)
 	if err != nil {
 		return err
 	}
@@ -178,7 +452,7 @@ func ListNodes(host string, onlyActive bool) ([]*models.Node, error) {
 	v.Set("active", strconv.FormatBool(onlyActive))
 	u.RawQuery = v.Encode()
 
-	resp, err := http.Get(u.String())
+	resp, err := get(u.String())
 	if err != nil {
 		return nil, err
 	}
@@ -199,6 +473,91 @@ func ListNodes(host string, onlyActive bool) ([]*models.Node, error) {
 	return ns, nil
 }
 
+// ListImages retrieves images cached on worker nodes, on all active nodes if nodes is empty.
+func ListImages(host string, nodes []string) ([]*models.NodeImages, error) {
+	u, err := url.Parse(host + "/v1/images")
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = url.Values{"node": nodes}.Encode()
+
+	resp, err := get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, raiseHTTPError(resp)
+	}
+
+	var images []*models.NodeImages
+	if err := json.NewDecoder(resp.Body).Decode(&images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// PullImages pulls images on worker nodes. It returns when all nodes have pulled all images.
+func PullImages(host string, req *models.PullImagesRequest) ([]*models.PullImageResult, error) {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(req); err != nil {
+		return nil, fmt.Errorf("encoding pull request to json: %w", err)
+	}
+
+	resp, err := post(host+"/v1/images:pull", &b)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, raiseHTTPError(resp)
+	}
+
+	var res []*models.PullImageResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// PruneImages removes unused images from worker nodes.
+func PruneImages(host string, req *models.PruneImagesRequest) ([]*models.PruneImagesResult, error) {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(req); err != nil {
+		return nil, fmt.Errorf("encoding prune request to json: %w", err)
+	}
+
+	resp, err := post(host+"/v1/images:prune", &b)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, raiseHTTPError(resp)
+	}
+
+	var res []*models.PruneImagesResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // new error with 'HTTP Status (Status Code): Body'
 // it doesn't close resp.Body reader
 func raiseHTTPError(resp *http.Response) error {
@@ -26,15 +26,15 @@ var cancelCmd = &cobra.Command{
 		}
 
 		if allTasks {
-			tasks, err := client.ListTasks(host, 0, "", models.Minimal, nil, models.ActiveStates())
-			exitOnErr(err)
-			for _, task := range tasks.Tasks {
+			err := client.ForEachTask(host, 0, models.Minimal, &models.TaskFilter{States: models.ActiveStates()}, func(task *models.Task) error {
 				if err := client.CancelTask(host, task.ID); err != nil {
 					message("Unable to cancel task %s: %v\n", task.ID, err)
-					continue
+					return nil
 				}
 				fmt.Println(task.ID)
-			}
+				return nil
+			})
+			exitOnErr(err)
 		}
 
 		for _, id := range args {
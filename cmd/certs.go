@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/labbcb/rnnr/server"
+	"github.com/spf13/cobra"
+)
+
+var tlsCert, tlsKey, tlsCA string
+var certsDir string
+var certsHosts []string
+var certsDays int
+
+var certsCmd = &cobra.Command{
+	Use:   "certs name...",
+	Short: "Generate TLS certificates",
+	Long: "This command generates certificates for mutual TLS between main and worker nodes.\n" +
+		"It creates a certificate authority (ca.crt and ca.key) in --dir if it does not exist.\n" +
+		"Then it issues a certificate (name.crt and name.key) for each name signed by this CA.\n" +
+		"Use --host to set the host names and IP addresses the certificates are valid for.\n" +
+		"By default the name is the host name.\n" +
+		"Keep ca.key safe. Anyone with it can issue certificates trusted by all nodes.",
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		validity := time.Duration(certsDays) * 24 * time.Hour
+
+		// A new CA is only created if there is none, replacing it would untrust all issued certificates.
+		var ca *server.CertificateAuthority
+		var err error
+		if caExists(certsDir) {
+			ca, err = server.LoadCertificateAuthority(certsDir)
+			exitOnErr(err)
+		} else {
+			ca, err = server.NewCertificateAuthority(certsDir, validity)
+			exitOnErr(err)
+			fmt.Println(filepath.Join(certsDir, "ca.crt"))
+		}
+
+		for _, name := range args {
+			exitOnErr(ca.Issue(certsDir, name, certsHosts, validity))
+			fmt.Println(filepath.Join(certsDir, name+".crt"))
+		}
+	},
+}
+
+// caExists returns true if ca.crt or ca.key exists in dir, or if it cannot be checked.
+func caExists(dir string) bool {
+	for _, name := range []string{"ca.crt", "ca.key"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// addTLSFlags adds flags to enable mutual TLS between main and worker nodes.
+func addTLSFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&tlsCert, "tls-cert", "", "TLS certificate file")
+	cmd.Flags().StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+	cmd.Flags().StringVar(&tlsCA, "tls-ca", "", "CA certificate file to verify peers")
+}
+
+// tlsEnabled returns true if any TLS flag is set.
+func tlsEnabled() bool {
+	return tlsCert != "" || tlsKey != "" || tlsCA != ""
+}
+
+func init() {
+	certsCmd.Flags().StringVarP(&certsDir, "dir", "d", "certs", "Directory to write certificates")
+	certsCmd.Flags().StringArrayVar(&certsHosts, "host", nil, "Host name or IP address of certificate")
+	certsCmd.Flags().IntVar(&certsDays, "days", 3650, "Days certificates are valid")
+	rootCmd.AddCommand(certsCmd)
+}
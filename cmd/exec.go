@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/labbcb/rnnr/client"
+	"github.com/labbcb/rnnr/models"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+)
+
+var execCmd = &cobra.Command{
+	Use:   "exec id -- command [arg...]",
+	Short: "Execute a command in a running task",
+	Long: "This command executes a command in the container of a running task with a terminal, like docker exec -it.\n" +
+		"It exits with the exit code of the command.\n" +
+		"Only admin users can execute commands if authentication is enabled.",
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		host := viper.GetString("host")
+		// Parsing stops at task ID, so the -- separating the command is kept in args.
+		command := args[1:]
+		if command[0] == "--" {
+			command = command[1:]
+		}
+		if len(command) == 0 {
+			messageAndExit("Command is required.\n")
+		}
+
+		var width, height int
+		restore := func() {}
+		resize := make(chan *models.ExecMessage, 1)
+		stdin := int(os.Stdin.Fd())
+		if term.IsTerminal(stdin) {
+			state, err := term.MakeRaw(stdin)
+			exitOnErr(err)
+			restore = func() {
+				_ = term.Restore(stdin, state)
+			}
+
+			stdout := int(os.Stdout.Fd())
+			width, height, _ = term.GetSize(stdout)
+			notifyResize(func() {
+				if w, h, err := term.GetSize(stdout); err == nil {
+					resize <- &models.ExecMessage{Width: uint32(w), Height: uint32(h)}
+				}
+			})
+		}
+
+		code, err := client.Exec(host, args[0], command, uint32(width), uint32(height), os.Stdin, os.Stdout, resize)
+		// Terminal must be restored before exiting.
+		restore()
+		exitOnErr(err)
+		os.Exit(code)
+	},
+}
+
+func init() {
+	// Flags after task ID belong to the command.
+	execCmd.Flags().SetInterspersed(false)
+	rootCmd.AddCommand(execCmd)
+}
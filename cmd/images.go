@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/labbcb/rnnr/client"
+	"github.com/labbcb/rnnr/models"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var imageNodes []string
+var imagePullPolicy string
+var pruneMaxSize string
+var pruneUnusedFor time.Duration
+
+var imagesCmd = &cobra.Command{
+	Use:   "images",
+	Short: "Manage images cached on worker nodes",
+	Long: "Images commands pre-pull, list and prune images of worker nodes.\n" +
+		"They act on all active nodes, or on the nodes given with one or more --node.\n" +
+		"Main server prefers nodes that already have the image of a task.",
+}
+
+var imagesListCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Short:   "List images cached on worker nodes",
+	Long: "It will print images of each node with size, when the node last used them and whether tasks use them.\n" +
+		"Images never used by the node were not pulled by RNNR and are never pruned.\n" +
+		"Use --format json to print in JSON format.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		host := viper.GetString("host")
+		nodes, err := client.ListImages(host, imageNodes)
+		exitOnErr(err)
+
+		if viper.GetString("format") == "json" {
+			exitOnErr(json.NewEncoder(os.Stdout).Encode(nodes))
+			return
+		}
+
+		fmt.Printf("%-20s   %-12s   %-9s   %-16s   %s\n", "Host", "ID", "Size", "Last used", "References")
+		for _, n := range nodes {
+			if n.Error != "" {
+				fmt.Printf("%-20s | %s\n", n.Host, n.Error)
+				continue
+			}
+			for _, i := range n.Images {
+				lastUsed := "-"
+				if i.LastUsed != nil {
+					lastUsed = i.LastUsed.Local().Format("2006-01-02 15:04")
+				}
+				refs := strings.Join(i.References, ", ")
+				if i.InUse {
+					refs += " (in use)"
+				}
+				fmt.Printf("%-20s | %-12s | %-9s | %-16s | %s\n", n.Host, shortImageID(i.ID), units.HumanSize(float64(i.Size)), lastUsed, refs)
+			}
+		}
+	},
+}
+
+var imagesPullCmd = &cobra.Command{
+	Use:   "pull image...",
+	Short: "Pull images on worker nodes",
+	Long: "It tells worker nodes to pull images, so that tasks using them start without waiting for downloads.\n" +
+		"Nodes pull images concurrently and the command returns when all nodes are done.\n" +
+		"Use --pull-policy always to pull newer versions of image tags.",
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		host := viper.GetString("host")
+		res, err := client.PullImages(host, &models.PullImagesRequest{Images: args, Nodes: imageNodes, PullPolicy: imagePullPolicy})
+		exitOnErr(err)
+
+		if viper.GetString("format") == "json" {
+			exitOnErr(json.NewEncoder(os.Stdout).Encode(res))
+			return
+		}
+
+		var failed bool
+		for _, r := range res {
+			switch {
+			case r.Error != "":
+				failed = true
+				fmt.Printf("%-20s | %s | ERROR %s\n", r.Host, r.Image, r.Error)
+			case r.Size > 0:
+				fmt.Printf("%-20s | %s | Pulled %s %s\n", r.Host, r.Image, units.HumanSize(float64(r.Size)), r.Digest)
+			default:
+				fmt.Printf("%-20s | %s | Up to date %s\n", r.Host, r.Image, r.Digest)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+var imagesPruneCmd = &cobra.Command{
+	Use:   "prune [--max-size size] [--unused-for duration]",
+	Short: "Remove unused images from worker nodes",
+	Long: "It removes images that no task uses from worker nodes, least recently used first.\n" +
+		"Use --max-size (like 100GB) to remove images until they take at most this size on each node.\n" +
+		"Use --unused-for (like 720h) to remove images not used for this long.\n" +
+		"Only images pulled or used by nodes are removed.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		req := &models.PruneImagesRequest{Nodes: imageNodes, UnusedSeconds: int64(pruneUnusedFor.Seconds())}
+		if pruneMaxSize != "" {
+			size, err := units.FromHumanSize(pruneMaxSize)
+			exitOnErr(err)
+			req.MaxSize = size
+		}
+		if req.MaxSize <= 0 && req.UnusedSeconds <= 0 {
+			messageAndExit("Use --max-size or --unused-for to select images to prune.\n")
+		}
+
+		host := viper.GetString("host")
+		res, err := client.PruneImages(host, req)
+		exitOnErr(err)
+
+		if viper.GetString("format") == "json" {
+			exitOnErr(json.NewEncoder(os.Stdout).Encode(res))
+			return
+		}
+
+		for _, r := range res {
+			if r.Error != "" {
+				fmt.Printf("%-20s | ERROR %s\n", r.Host, r.Error)
+				continue
+			}
+			for _, i := range r.Removed {
+				fmt.Printf("%-20s | Removed %s %s\n", r.Host, shortImageID(i.ID), strings.Join(i.References, ", "))
+			}
+			fmt.Printf("%-20s | Reclaimed %s\n", r.Host, units.HumanSize(float64(r.Reclaimed)))
+		}
+	},
+}
+
+// shortImageID shortens Docker image IDs like docker images does.
+func shortImageID(id string) string {
+	if strings.HasPrefix(id, "sha256:") && len(id) > 19 {
+		return id[7:19]
+	}
+	return id
+}
+
+func init() {
+	imagesCmd.PersistentFlags().StringArrayVarP(&imageNodes, "node", "n", nil, "Worker nodes, all active nodes if not given.")
+	imagesPullCmd.Flags().StringVar(&imagePullPolicy, "pull-policy", "", "Pull policy: always, if-not-present or never. Default is node pull policy.")
+	imagesPruneCmd.Flags().StringVar(&pruneMaxSize, "max-size", "", "Maximum size of images on each node.")
+	imagesPruneCmd.Flags().DurationVar(&pruneUnusedFor, "unused-for", 0, "Remove images not used for this long.")
+	imagesCmd.AddCommand(imagesListCmd, imagesPullCmd, imagesPruneCmd)
+	rootCmd.AddCommand(imagesCmd)
+}
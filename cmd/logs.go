@@ -1,43 +1,72 @@
 package cmd
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
 	"github.com/labbcb/rnnr/client"
 	"github.com/labbcb/rnnr/models"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-var stdout, stderr bool
+var stdout, stderr, follow bool
+var tail int
 
 var logsCmd = &cobra.Command{
 	Use:   "logs id",
 	Short: "Get task logs",
 	Long: "Task provides many logs. By default it prints system logs.\n" +
-		"Use --stdout and --stderr to get executor logs.",
+		"Use --stdout and --stderr to get executor logs, also available while task is running.\n" +
+		"Use --follow to keep printing executor logs until task finishes, like docker logs --follow.\n" +
+		"It prints both standard output and error if none of them is selected.\n" +
+		"Use --tail to print only the last lines of executor logs.",
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		host := viper.GetString("host")
-		t, err := client.GetTask(host, args[0], models.Full)
-		exitOnErr(err)
+		id := args[0]
 
-		if t.Active() {
+		if !stdout && !stderr && !follow {
+			t, err := client.GetTask(host, id, models.Full)
+			exitOnErr(err)
+			for _, l := range t.Logs {
+				for _, line := range l.SystemLogs {
+					fmt.Println(line)
+				}
+			}
 			return
 		}
-		if stdout || stderr {
-			if stdout {
-				println(t.Logs[0].ExecutorLogs[0].Stdout)
-			}
-			if stderr {
-				println(t.Logs[0].ExecutorLogs[0].Stderr)
-			}
-		} else {
-			println(t.Logs[0].SystemLogs)
+		if !stdout && !stderr {
+			stdout, stderr = true, true
+		}
+
+		// Each stream is requested separately to print it to the same output of the task.
+		streams := map[string]io.Writer{}
+		if stdout {
+			streams["stdout"] = os.Stdout
+		}
+		if stderr {
+			streams["stderr"] = os.Stderr
+		}
+
+		var wg sync.WaitGroup
+		for stream, w := range streams {
+			wg.Add(1)
+			go func(stream string, w io.Writer) {
+				defer wg.Done()
+				exitOnErr(client.TaskLogs(host, id, stream, follow, tail, w))
+			}(stream, w)
 		}
+		wg.Wait()
 	},
 }
 
 func init() {
 	logsCmd.Flags().BoolVar(&stdout, "stdout", false, "Prints executor standard out")
 	logsCmd.Flags().BoolVar(&stderr, "stderr", false, "Prints executor standard error")
+	logsCmd.Flags().BoolVarP(&follow, "follow", "F", false, "Follow executor logs of running task")
+	logsCmd.Flags().IntVar(&tail, "tail", 0, "Number of lines from the end of executor logs, all lines if zero")
 	rootCmd.AddCommand(logsCmd)
 }
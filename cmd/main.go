@@ -7,10 +7,15 @@ import (
 	"github.com/labbcb/rnnr/server"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"google.golang.org/grpc/credentials"
 )
 
-var database, address string
-var sleepTime int
+var database, address, archiveDir, environment string
+var sleepTime, retentionDays int
+var httpsCert, httpsKey, httpsClientCA, httpRedirect string
+var authTokens, authHtpasswd, authJWKS, authIssuer, authAudience, rolesFile, userMapFile string
+var requireDigest, allowNetwork, allowWritableRootfs bool
+var allowedRegistries, allowedCapabilities []string
 
 var mainCmd = &cobra.Command{
 	Use:     "main",
@@ -19,16 +24,91 @@ var mainCmd = &cobra.Command{
 	Long: "Start the RNNR main server instance.\n" +
 		"It will listen port 8080. Use --address to change the port suffixed with colon.\n" +
 		"It will connect with MongoDB. use --database to change URL.\n" +
-		"By default monitoring system will iterate over tasks and sleep. Use --time to change sleep time.",
+		"By default monitoring system will iterate over tasks and sleep. Use --time to change sleep time.\n" +
+		"Terminated tasks are kept forever. Use --retention to delete them after some days.\n" +
+		"Use --archive to save deleted tasks as compressed JSON Lines files in a directory.\n" +
+		"Authentication is disabled by default. Enable it with one or more of:\n" +
+		"--auth-tokens file with a user name and a bearer token per line;\n" +
+		"--auth-htpasswd file with users and bcrypt passwords for HTTP basic authentication;\n" +
+		"--auth-jwks file with a JSON Web Key Set to verify JWT bearer tokens (user name is sub claim).\n" +
+		"Authenticated users are submitters, who only see and cancel their own tasks,\n" +
+		"unless --roles file maps roles (admin, operator, submitter, viewer) to users.\n" +
+		"Use --tls-cert, --tls-key and --tls-ca to connect to worker nodes with mutual TLS.\n" +
+		"Use --https-cert and --https-key to serve the API over HTTPS. Files are reloaded when they change.\n" +
+		"Use --https-client-ca to authenticate users by client certificates (user name is common name).\n" +
+		"Use --http-redirect to listen for HTTP requests on another address and redirect them to HTTPS.\n" +
+		"Use --require-digest to reject tasks whose images are not referenced by digest (image@sha256:...)\n" +
+		"and one or more --allowed-registry to reject tasks whose images come from other registries.\n" +
+		"Tasks may relax worker security profiles with network, writable_rootfs and capabilities backend parameters\n" +
+		"only if allowed with --allow-network, --allow-writable-rootfs and --allow-capability.\n" +
+		"Use --user-map file with a task owner or tag (key=value) and a UID:GID per line to run tasks as these users.",
 	Run: func(cmd *cobra.Command, args []string) {
 		log.SetFormatter(&log.TextFormatter{
 			FullTimestamp: true,
 		})
 
+		if tlsEnabled() {
+			config, err := server.ClientTLS(tlsCert, tlsKey, tlsCA)
+			exitOnErr(err)
+			server.WorkerCredentials = credentials.NewTLS(config)
+		}
+
 		m, err := server.NewMain(database, time.Duration(sleepTime)*time.Second)
 		exitOnErr(err)
 
-		log.Fatal(http.ListenAndServe(address, m.Router))
+		m.ArchiveDir = archiveDir
+		m.ServiceInfo.Environment = environment
+		m.ImagePolicy = server.ImagePolicy{RequireDigest: requireDigest, Registries: allowedRegistries}
+		m.SecurityPolicy = server.SecurityPolicy{AllowNetwork: allowNetwork, AllowWritableRootfs: allowWritableRootfs, Capabilities: allowedCapabilities}
+
+		if authTokens != "" {
+			a, err := server.NewTokenAuth(authTokens)
+			exitOnErr(err)
+			m.Authenticators = append(m.Authenticators, a)
+		}
+		if authHtpasswd != "" {
+			a, err := server.NewBasicAuth(authHtpasswd)
+			exitOnErr(err)
+			m.Authenticators = append(m.Authenticators, a)
+		}
+		if authJWKS != "" {
+			a, err := server.NewJWTAuth(authJWKS, authIssuer, authAudience)
+			exitOnErr(err)
+			m.Authenticators = append(m.Authenticators, a)
+		}
+		if httpsClientCA != "" {
+			if httpsCert == "" || httpsKey == "" {
+				messageAndExit("--https-client-ca requires HTTPS with --https-cert and --https-key.\n")
+			}
+			m.Authenticators = append(m.Authenticators, server.CertificateAuth{})
+		}
+		if rolesFile != "" {
+			m.Roles, err = server.LoadRoles(rolesFile)
+			exitOnErr(err)
+		}
+
+		if userMapFile != "" {
+			m.Users, err = server.LoadUserMap(userMapFile)
+			exitOnErr(err)
+		}
+
+		if retentionDays > 0 {
+			go m.StartTaskPurger(time.Duration(retentionDays)*24*time.Hour, time.Hour)
+		}
+
+		if httpsCert == "" && httpsKey == "" {
+			log.Fatal(http.ListenAndServe(address, m.Router))
+		}
+
+		config, err := server.HTTPSConfig(httpsCert, httpsKey, httpsClientCA)
+		exitOnErr(err)
+		if httpRedirect != "" {
+			go func() {
+				log.Fatal(http.ListenAndServe(httpRedirect, server.RedirectHTTPS(address)))
+			}()
+		}
+		srv := &http.Server{Addr: address, Handler: m.Router, TLSConfig: config}
+		log.Fatal(srv.ListenAndServeTLS("", ""))
 	},
 }
 
@@ -36,5 +116,25 @@ func init() {
 	mainCmd.PersistentFlags().StringVarP(&database, "database", "d", "mongodb://localhost:27017", "URL to Mongo database")
 	mainCmd.PersistentFlags().StringVarP(&address, "address", "a", ":8080", "Address to bind server")
 	mainCmd.Flags().IntVarP(&sleepTime, "time", "t", 5, "Sleep time in second for monitoring system.")
+	mainCmd.Flags().IntVar(&retentionDays, "retention", 0, "Days to keep terminated tasks. Zero keeps tasks forever.")
+	mainCmd.Flags().StringVar(&archiveDir, "archive", "", "Directory to archive tasks before deleting them.")
+	mainCmd.Flags().StringVar(&environment, "environment", "", "Environment reported by service info, like test or prod.")
+	mainCmd.Flags().StringVar(&httpsCert, "https-cert", "", "TLS certificate file to serve HTTPS.")
+	mainCmd.Flags().StringVar(&httpsKey, "https-key", "", "TLS private key file to serve HTTPS.")
+	mainCmd.Flags().StringVar(&httpsClientCA, "https-client-ca", "", "CA certificates file to verify client certificates.")
+	mainCmd.Flags().StringVar(&httpRedirect, "http-redirect", "", "Address to redirect HTTP requests to HTTPS.")
+	mainCmd.Flags().StringVar(&authTokens, "auth-tokens", "", "File with user names and bearer tokens.")
+	mainCmd.Flags().StringVar(&authHtpasswd, "auth-htpasswd", "", "Htpasswd file for HTTP basic authentication.")
+	mainCmd.Flags().StringVar(&authJWKS, "auth-jwks", "", "JSON Web Key Set file to verify JWT bearer tokens.")
+	mainCmd.Flags().StringVar(&authIssuer, "auth-jwt-issuer", "", "Required JWT issuer (iss claim).")
+	mainCmd.Flags().StringVar(&authAudience, "auth-jwt-audience", "", "Required JWT audience (aud claim).")
+	mainCmd.Flags().StringVar(&rolesFile, "roles", "", "File mapping roles to user names.")
+	mainCmd.Flags().StringVar(&userMapFile, "user-map", "", "File mapping task owners and tags to UID:GID that run tasks.")
+	mainCmd.Flags().BoolVar(&requireDigest, "require-digest", false, "Reject tasks whose images are not referenced by digest.")
+	mainCmd.Flags().StringArrayVar(&allowedRegistries, "allowed-registry", nil, "Registry (optionally with repository path) that task images may come from.")
+	mainCmd.Flags().BoolVar(&allowNetwork, "allow-network", false, "Allow tasks to request network access.")
+	mainCmd.Flags().BoolVar(&allowWritableRootfs, "allow-writable-rootfs", false, "Allow tasks to request a writable root filesystem.")
+	mainCmd.Flags().StringArrayVar(&allowedCapabilities, "allow-capability", nil, "Linux capability that tasks may request.")
+	addTLSFlags(mainCmd)
 	rootCmd.AddCommand(mainCmd)
 }
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/labbcb/rnnr/client"
+	"github.com/labbcb/rnnr/models"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var purgeBefore string
+var purgeStates []string
+
+var purgeCmd = &cobra.Command{
+	Use:   "purge --before date [--state state]...",
+	Short: "Delete terminated tasks",
+	Long: "This command tells main server to delete tasks that ended before the given date.\n" +
+		"Date format is YYYY-MM-DD or RFC 3339 (2006-01-02T15:04:05Z07:00).\n" +
+		"Use one or more --state parameter to delete only tasks in these states.\n" +
+		"Valid states are complete, executor_error, system_error, canceled and preempted.\n" +
+		"Tasks are archived before deletion if main server was started with --archive.\n" +
+		"It will print the number of deleted tasks.",
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		before, err := parseDate(purgeBefore)
+		exitOnErr(err)
+
+		var filterStates []models.State
+		for _, state := range purgeStates {
+			s := models.State(strings.ToUpper(state))
+			if !s.Terminated() {
+				messageAndExit("Invalid state %s. Only terminated tasks can be purged.\n", state)
+			}
+			filterStates = append(filterStates, s)
+		}
+
+		host := viper.GetString("host")
+		n, err := client.PurgeTasks(host, before, filterStates)
+		exitOnErr(err)
+		fmt.Println(n)
+	},
+}
+
+// parseDate parses date as YYYY-MM-DD (local time) or RFC 3339.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q: use YYYY-MM-DD or RFC 3339 format", s)
+	}
+	return t, nil
+}
+
+func init() {
+	purgeCmd.Flags().StringVarP(&purgeBefore, "before", "b", "", "Delete tasks that ended before this date.")
+	purgeCmd.Flags().StringArrayVarP(&purgeStates, "state", "s", nil, "Delete only tasks in these states.")
+	exitOnErr(purgeCmd.MarkFlagRequired("before"))
+	rootCmd.AddCommand(purgeCmd)
+}
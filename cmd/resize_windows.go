@@ -0,0 +1,4 @@
+package cmd
+
+// notifyResize does nothing because Windows does not signal terminal resizes.
+func notifyResize(func()) {}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/labbcb/rnnr/client"
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
 
@@ -35,8 +36,16 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default $HOME/.rnnr.yaml)")
 	rootCmd.PersistentFlags().String("host", "http://localhost:8080", "RNNR server URL")
 	rootCmd.PersistentFlags().StringP("format", "f", "console", "Output format. JSON or console")
+	rootCmd.PersistentFlags().String("token", "", "Bearer token to authenticate with RNNR server")
+	rootCmd.PersistentFlags().String("ca-cert", "", "CA certificates file to verify RNNR server")
+	rootCmd.PersistentFlags().String("client-cert", "", "Client certificate file to authenticate with RNNR server")
+	rootCmd.PersistentFlags().String("client-key", "", "Client private key file")
 	exitOnErr(viper.BindPFlag("host", rootCmd.PersistentFlags().Lookup("host")))
 	exitOnErr(viper.BindPFlag("format", rootCmd.PersistentFlags().Lookup("format")))
+	exitOnErr(viper.BindPFlag("token", rootCmd.PersistentFlags().Lookup("token")))
+	exitOnErr(viper.BindPFlag("ca-cert", rootCmd.PersistentFlags().Lookup("ca-cert")))
+	exitOnErr(viper.BindPFlag("client-cert", rootCmd.PersistentFlags().Lookup("client-cert")))
+	exitOnErr(viper.BindPFlag("client-key", rootCmd.PersistentFlags().Lookup("client-key")))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -63,6 +72,9 @@ func initConfig() {
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Println("Using config file:", viper.ConfigFileUsed())
 	}
+
+	client.Token = viper.GetString("token")
+	exitOnErr(client.SetTLS(viper.GetString("ca-cert"), viper.GetString("client-cert"), viper.GetString("client-key")))
 }
 
 func message(format string, a ...interface{}) {
@@ -15,7 +15,9 @@ import (
 )
 
 var all, errors bool
-var nodes, states []string
+var nodes, states, tags []string
+var namePrefix string
+var pageSize int
 
 var tasksCmd = &cobra.Command{
 	Use:     "tasks",
@@ -27,6 +29,10 @@ var tasksCmd = &cobra.Command{
 		"Valid states are queued, initializing, running, paused, complete,\n" +
 		"executor_error, system_error and canceled. States are case insensitive.\n" +
 		"Use one or more --node parameter to filter by worker nodes.\n" +
+		"Use --name to filter by task name prefix.\n" +
+		"Use one or more --tag parameter to filter by tags as key=value.\n" +
+		"A tag without value (key or key=) matches any value.\n" +
+		"Tasks are requested in pages. Use --page-size to change the number of tasks per request.\n" +
 		"Use --format csv to export as CSV.",
 	Run: func(cmd *cobra.Command, args []string) {
 		if all && errors {
@@ -47,94 +53,148 @@ var tasksCmd = &cobra.Command{
 			}
 		}
 
-		host := viper.GetString("host")
-		resp, err := client.ListTasks(host, 0, "", models.Basic, nodes, filterStates)
-		exitOnErr(err)
+		filter := &models.TaskFilter{
+			NamePrefix: namePrefix,
+			Nodes:      nodes,
+			States:     filterStates,
+		}
+		for _, tag := range tags {
+			if filter.Tags == nil {
+				filter.Tags = make(map[string]string)
+			}
+			key, value := tag, ""
+			if i := strings.Index(tag, "="); i >= 0 {
+				key, value = tag[:i], tag[i+1:]
+			}
+			if key == "" {
+				messageAndExit("Invalid tag %q. Use key=value.\n", tag)
+			}
+			filter.Tags[key] = value
+		}
 
+		host := viper.GetString("host")
 		format := viper.GetString("format")
-		if format == "json" {
-			err := json.NewEncoder(os.Stdout).Encode(resp.Tasks)
-			exitOnErr(err)
-			return
+
+		var printTask func(*models.Task) error
+		var flush func() error
+		switch format {
+		case "json":
+			printTask, flush = jsonTaskPrinter()
+		case "csv":
+			printTask, flush = csvTaskPrinter()
+		default:
+			printTask, flush = consoleTaskPrinter(all || errors)
 		}
 
-		if format == "csv" {
-			w := csv.NewWriter(os.Stdout)
-			w.Write([]string{
-				"id",
-				"name",
-				"description",
-				"state",
-				"created",
-				"cpu_cores",
-				"memory_gb",
-				"worker_node",
-				"cpu_time",
-				"max_cpu_percentage",
-				"max_memory_bytes",
-				"started",
-				"completed",
-				"executor_started",
-				"executor_completed",
-				"exit_code",
-			})
-
-			for _, t := range resp.Tasks {
-				var started, completed, executorStarted, executorCompleted, exitCode string
-				if t.Terminated() {
-					started = t.Logs[0].StartTime.String()
-					completed = t.Logs[0].EndTime.String()
-					executorStarted = t.Logs[0].ExecutorLogs[0].StartTime.String()
-					executorCompleted = t.Logs[0].ExecutorLogs[0].EndTime.String()
-					exitCode = strconv.FormatInt(int64(t.Logs[0].ExecutorLogs[0].ExitCode), 10)
-				}
-
-				r := []string{
-					t.ID,
-					t.Name,
-					t.Description,
-					string(t.State),
-					t.Created.String(),
-					strconv.FormatInt(int64(t.Resources.CPUCores), 10),
-					strconv.FormatFloat(t.Resources.RAMGb, 'f', -1, 64),
-					t.Host,
-					strconv.FormatUint(t.Metrics.CPUTime, 10),
-					strconv.FormatFloat(t.Metrics.CPUPercentage, 'f', -1, 64),
-					strconv.FormatUint(t.Metrics.Memory, 10),
-					started,
-					completed,
-					executorStarted,
-					executorCompleted,
-					exitCode,
-				}
-				err := w.Write(r)
-				exitOnErr(err)
-			}
+		exitOnErr(client.ForEachTask(host, pageSize, models.Basic, filter, printTask))
+		exitOnErr(flush())
+	},
+}
 
-			w.Flush()
-			exitOnErr(w.Error())
-			return
+// jsonTaskPrinter prints tasks as a JSON array without keeping them in memory.
+func jsonTaskPrinter() (printTask func(*models.Task) error, flush func() error) {
+	enc := json.NewEncoder(os.Stdout)
+	sep := "["
+	printTask = func(t *models.Task) error {
+		fmt.Print(sep)
+		sep = ","
+		return enc.Encode(t)
+	}
+	flush = func() error {
+		if sep == "[" {
+			fmt.Print(sep)
 		}
+		fmt.Println("]")
+		return nil
+	}
+	return
+}
 
-		var line string
-		for _, task := range resp.Tasks {
-			line = fmt.Sprintf("%36s | CPU=%02d RAM=%05.2fGB", task.ID, task.Resources.CPUCores, task.Resources.RAMGb)
+// csvTaskPrinter prints a header line and one task per line as CSV.
+func csvTaskPrinter() (printTask func(*models.Task) error, flush func() error) {
+	w := csv.NewWriter(os.Stdout)
+	header := []string{
+		"id",
+		"name",
+		"description",
+		"state",
+		"created",
+		"cpu_cores",
+		"memory_gb",
+		"worker_node",
+		"cpu_time",
+		"max_cpu_percentage",
+		"max_memory_bytes",
+		"started",
+		"completed",
+		"executor_started",
+		"executor_completed",
+		"exit_code",
+	}
+	headerErr := w.Write(header)
+
+	printTask = func(t *models.Task) error {
+		var started, completed, executorStarted, executorCompleted, exitCode string
+		if t.Terminated() {
+			started = t.Logs[0].StartTime.String()
+			completed = t.Logs[0].EndTime.String()
+			executorStarted = t.Logs[0].ExecutorLogs[0].StartTime.String()
+			executorCompleted = t.Logs[0].ExecutorLogs[0].EndTime.String()
+			exitCode = strconv.FormatInt(int64(t.Logs[0].ExecutorLogs[0].ExitCode), 10)
+		}
 
-			if all || errors {
-				line = fmt.Sprintf("%s | %-14s", line, task.State)
-			} else {
-				line = fmt.Sprintf("%s | %-8s", line, task.State)
-			}
+		return w.Write([]string{
+			t.ID,
+			t.Name,
+			t.Description,
+			string(t.State),
+			t.Created.String(),
+			strconv.FormatInt(int64(t.Resources.CPUCores), 10),
+			strconv.FormatFloat(t.Resources.RAMGb, 'f', -1, 64),
+			t.Host,
+			strconv.FormatUint(t.Metrics.CPUTime, 10),
+			strconv.FormatFloat(t.Metrics.CPUPercentage, 'f', -1, 64),
+			strconv.FormatUint(t.Metrics.Memory, 10),
+			started,
+			completed,
+			executorStarted,
+			executorCompleted,
+			exitCode,
+		})
+	}
+	flush = func() error {
+		if headerErr != nil {
+			return headerErr
+		}
+		w.Flush()
+		return w.Error()
+	}
+	return
+}
 
-			if task.Host != "" {
-				line = fmt.Sprintf("%s | %s at %s (%s)", line, task.Name, task.Host, task.Elapsed())
-			} else {
-				line = fmt.Sprintf("%s | %s", line, task.Name)
-			}
+// consoleTaskPrinter prints one task per line.
+// wideState must be true if tasks can be in any state, to align long state names.
+func consoleTaskPrinter(wideState bool) (printTask func(*models.Task) error, flush func() error) {
+	printTask = func(task *models.Task) error {
+		line := fmt.Sprintf("%36s | CPU=%02d RAM=%05.2fGB", task.ID, task.Resources.CPUCores, task.Resources.RAMGb)
 
-			fmt.Println(line)
+		if wideState {
+			line = fmt.Sprintf("%s | %-14s", line, task.State)
+		} else {
+			line = fmt.Sprintf("%s | %-8s", line, task.State)
 		}
-	},
+
+		if task.Host != "" {
+			line = fmt.Sprintf("%s | %s at %s (%s)", line, task.Name, task.Host, task.Elapsed())
+		} else {
+			line = fmt.Sprintf("%s | %s", line, task.Name)
+		}
+
+		fmt.Println(line)
+		return nil
+	}
+	flush = func() error { return nil }
+	return
 }
 
 func init() {
@@ -142,5 +202,8 @@ func init() {
 	tasksCmd.Flags().BoolVarP(&errors, "error", "e", false, "Print only tasks with error states.")
 	tasksCmd.Flags().StringArrayVarP(&nodes, "node", "n", nil, "Filter tasks by worker nodes.")
 	tasksCmd.Flags().StringArrayVarP(&states, "state", "s", nil, "Filter tasks by task states.")
+	tasksCmd.Flags().StringVar(&namePrefix, "name", "", "Filter tasks by name prefix.")
+	tasksCmd.Flags().StringArrayVarP(&tags, "tag", "t", nil, "Filter tasks by tag as key=value.")
+	tasksCmd.Flags().IntVar(&pageSize, "page-size", 256, "Number of tasks per request.")
 	rootCmd.AddCommand(tasksCmd)
 }
@@ -1,19 +1,30 @@
 package cmd
 
 import (
+	"context"
 	"net"
+	"strings"
+	"time"
 
+	units "github.com/docker/go-units"
 	"github.com/labbcb/rnnr/proto"
 	"github.com/labbcb/rnnr/server"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
-var port, user, group string
+var port, user, group, stateDir, runtimeName, pullPolicy, registryConfig string
+var keepCapabilities, allowNewPrivileges, readOnlyRootfs bool
+var seccompProfile, apparmorProfile, network string
+var scratchDir, scratchSize string
+var keepFailedScratch time.Duration
 var cpuCores int32
 var ramGb float64
-var volumes []string
+var volumes, allowedUIDs, allowedGIDs []string
 
 var workerCmd = &cobra.Command{
 	Use:     "worker",
@@ -22,15 +33,76 @@ var workerCmd = &cobra.Command{
 	Long: "Start RNNR worker server instance.\n" +
 		"It will listen port 50051 by default.\n" +
 		"Use --port to change this value.\n" +
-		"It requires access to Docker socket.",
+		"It requires access to Docker socket.\n" +
+		"Use --runtime podman or --runtime apptainer to run containers with Podman or Apptainer instead of Docker.\n" +
+		"Use --runtime local to run task commands directly, without containers.\n" +
+		"States of exited containers are kept in --state-dir (/var/lib/rnnr) until main server no longer needs them.\n" +
+		"It must be a persistent directory, writable by the worker user.\n" +
+		"Containers run without Linux capabilities and with no-new-privileges, unless --keep-capabilities or --allow-new-privileges.\n" +
+		"Previous versions kept them, so use both flags for images that need capabilities or setuid helpers.\n" +
+		"Harden them further with --read-only, --seccomp-profile, --apparmor-profile and --network none.\n" +
+		"Main server may let tasks relax some of them. The local runtime is not hardened.\n" +
+		"Main server may run tasks as other users (UID:GID) allowed with --allowed-uid and --allowed-gid.\n" +
+		"Use --scratch-dir to give each task a scratch directory on a local disk, mounted at /scratch and set as TMPDIR.\n" +
+		"Limit it with --scratch-size and keep it after failures with --keep-failed-scratch.\n" +
+		"Only the worker user may write to scratch directories, unless tasks run as other users (UID:GID).\n" +
+		"Then they are owned by these users if worker runs as root, otherwise any local user may write to them.\n" +
+		"Use --tls-cert, --tls-key and --tls-ca to only accept connections from main servers with a certificate signed by CA.",
 	Run: func(cmd *cobra.Command, args []string) {
 		log.SetFormatter(&log.TextFormatter{
 			FullTimestamp: true,
 		})
 
-		w, err := server.NewWorker(cpuCores, ramGb, volumes, user, group)
+		policy, err := server.ParsePullPolicy(pullPolicy)
+		exitOnErr(err)
+		registries, err := server.LoadRegistryAuths(registryConfig)
+		exitOnErr(err)
+		if network != "default" && network != "none" {
+			messageAndExit("Invalid network %s. Use default or none.\n", network)
+		}
+		uids, err := server.ParseIDRanges(allowedUIDs)
+		exitOnErr(err)
+		gids, err := server.ParseIDRanges(allowedGIDs)
 		exitOnErr(err)
 
+		// Local runtime cannot drop capabilities or set no-new-privileges, so it is not hardened by default.
+		hardened := runtimeName != "local"
+		rt, err := server.NewRuntime(runtimeName, server.RuntimeOptions{
+			Dir:        stateDir,
+			Volumes:    volumes,
+			User:       user,
+			Group:      group,
+			Registries: registries,
+			Security: server.SecurityProfile{
+				DropCapabilities: hardened && !keepCapabilities,
+				NoNewPrivileges:  hardened && !allowNewPrivileges,
+				ReadOnlyRootfs:   readOnlyRootfs,
+				Seccomp:          seccompProfile,
+				AppArmor:         apparmorProfile,
+				NetworkNone:      network == "none",
+			},
+		})
+		exitOnErr(err)
+		if hardened && (!keepCapabilities || !allowNewPrivileges) {
+			log.Info("Containers run without Linux capabilities and with no-new-privileges. " +
+				"Use --keep-capabilities and --allow-new-privileges if task images need them.")
+		}
+
+		w, err := server.NewWorker(rt, cpuCores, ramGb, stateDir)
+		exitOnErr(err)
+		w.PullPolicy = policy
+		w.AllowedUIDs, w.AllowedGIDs = uids, gids
+		if scratchDir != "" {
+			var size int64
+			if scratchSize != "" {
+				size, err = units.FromHumanSize(scratchSize)
+				exitOnErr(err)
+			}
+			w.Scratch, err = server.NewScratchSpace(scratchDir, size, keepFailedScratch)
+			exitOnErr(err)
+		}
+		exitOnErr(w.Recover(context.Background()))
+
 		if w.Info.CpuCores > w.Info.IdentifiedCpuCores {
 			log.Warnf("Defined number of CPU cores (%d) is greater than identified (%d).", w.Info.CpuCores, w.Info.IdentifiedCpuCores)
 		}
@@ -42,8 +114,18 @@ var workerCmd = &cobra.Command{
 		lis, err := net.Listen("tcp", ":"+port)
 		exitOnErr(err)
 
-		server := grpc.NewServer()
+		opts := []grpc.ServerOption{grpc.KeepaliveEnforcementPolicy(server.WorkerKeepalivePolicy)}
+		if tlsEnabled() {
+			config, err := server.ServerTLS(tlsCert, tlsKey, tlsCA)
+			exitOnErr(err)
+			opts = append(opts, grpc.Creds(credentials.NewTLS(config)))
+		} else {
+			log.Warn("TLS is disabled. Anyone with network access can run containers.")
+		}
+
+		server := grpc.NewServer(opts...)
 		proto.RegisterWorkerServer(server, w)
+		healthpb.RegisterHealthServer(server, health.NewServer())
 		exitOnErr(server.Serve(lis))
 	},
 }
@@ -55,5 +137,21 @@ func init() {
 	workerCmd.Flags().StringArrayVarP(&volumes, "volume", "v", []string{}, "Volumes to mount in containers")
 	workerCmd.Flags().StringVarP(&user, "user", "u", "root", "User name or UID")
 	workerCmd.Flags().StringVarP(&group, "group", "g", "root", "Group name or GID")
+	workerCmd.Flags().StringVar(&runtimeName, "runtime", "docker", "Container runtime: "+strings.Join(server.Runtimes, ", "))
+	workerCmd.Flags().StringVar(&pullPolicy, "pull", string(server.PullIfNotPresent), "Image pull policy of tasks without pull_policy backend parameter: always, if-not-present or never")
+	workerCmd.Flags().StringVar(&registryConfig, "registry-config", server.DefaultRegistryConfig(), "Docker config file with private registry credentials")
+	workerCmd.Flags().StringVar(&stateDir, "state-dir", "/var/lib/rnnr", "Persistent directory to keep states of exited containers, image usage, and Apptainer and local containers")
+	workerCmd.Flags().BoolVar(&keepCapabilities, "keep-capabilities", false, "Keep default Linux capabilities of container runtime instead of dropping all of them")
+	workerCmd.Flags().BoolVar(&allowNewPrivileges, "allow-new-privileges", false, "Let container processes gain privileges, for example with setuid executables")
+	workerCmd.Flags().BoolVar(&readOnlyRootfs, "read-only", false, "Make container root filesystem read-only, with a writable /tmp")
+	workerCmd.Flags().StringVar(&seccompProfile, "seccomp-profile", "", "Seccomp profile file of containers")
+	workerCmd.Flags().StringVar(&apparmorProfile, "apparmor-profile", "", "AppArmor profile name of containers")
+	workerCmd.Flags().StringVar(&network, "network", "default", "Container network: default or none")
+	workerCmd.Flags().StringArrayVar(&allowedUIDs, "allowed-uid", nil, "UIDs or ranges of UIDs (like 1000-1999) that main server may run tasks as")
+	workerCmd.Flags().StringArrayVar(&allowedGIDs, "allowed-gid", nil, "GIDs or ranges of GIDs that main server may run tasks as")
+	workerCmd.Flags().StringVar(&scratchDir, "scratch-dir", "", "Directory on a local disk to create scratch directories of tasks, writable only by the worker user or task user, disabled if empty")
+	workerCmd.Flags().StringVar(&scratchSize, "scratch-size", "", "Maximum size of each scratch directory (like 100GB), requires root and XFS project quotas or loop devices")
+	workerCmd.Flags().DurationVar(&keepFailedScratch, "keep-failed-scratch", 0, "Keep scratch directories of failed tasks for this long (like 24h)")
+	addTLSFlags(workerCmd)
 	rootCmd.AddCommand(workerCmd)
 }
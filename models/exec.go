@@ -0,0 +1,11 @@
+package models
+
+// ExecMessage is a control message of an exec session, sent as a WebSocket text message.
+// Terminal input and output are sent as binary messages.
+// Clients send it with Width and Height to resize the terminal.
+// Main server sends it with ExitCode when command exits, then closes the connection.
+type ExecMessage struct {
+	Width    uint32 `json:"width,omitempty"`
+	Height   uint32 `json:"height,omitempty"`
+	ExitCode *int32 `json:"exit_code,omitempty"`
+}
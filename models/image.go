@@ -0,0 +1,61 @@
+package models
+
+import "time"
+
+// Image is an image cached on a node.
+type Image struct {
+	ID         string   `json:"id"`
+	References []string `json:"references,omitempty"`
+	// Size in bytes. Docker images may share layers, so sizes of images do not add up.
+	Size int64 `json:"size"`
+	// LastUsed is when the node last pulled the image or ran a task with it, nil if never.
+	LastUsed *time.Time `json:"last_used,omitempty"`
+	// InUse is true if some container uses the image.
+	InUse bool `json:"in_use"`
+}
+
+// NodeImages has images cached on a node, or why they could not be listed.
+type NodeImages struct {
+	Host   string   `json:"host"`
+	Images []*Image `json:"images"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// PullImagesRequest pulls images on nodes.
+type PullImagesRequest struct {
+	Images []string `json:"images"`
+	// Nodes are hosts of nodes, all active nodes if empty
+	Nodes []string `json:"nodes,omitempty"`
+	// PullPolicy is always, if-not-present or never, node default if empty
+	PullPolicy string `json:"pull_policy,omitempty"`
+}
+
+// PullImageResult tells whether an image was pulled on a node.
+type PullImageResult struct {
+	Host  string `json:"host"`
+	Image string `json:"image"`
+	// Size is the downloaded bytes, zero if image was up to date.
+	Size int64 `json:"size"`
+	// Digest is the repository digest of the image, like ubuntu@sha256:..., if it is known.
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// PruneImagesRequest removes images that no task uses from nodes, least recently used first.
+// Only images pulled or used by nodes are removed.
+type PruneImagesRequest struct {
+	// Nodes are hosts of nodes, all active nodes if empty
+	Nodes []string `json:"nodes,omitempty"`
+	// MaxSize is the maximum bytes images may take on each node, no limit if zero
+	MaxSize int64 `json:"max_size,omitempty"`
+	// UnusedSeconds removes images unused for longer, no limit if zero
+	UnusedSeconds int64 `json:"unused_seconds,omitempty"`
+}
+
+// PruneImagesResult has the images removed from a node and the bytes they took.
+type PruneImagesResult struct {
+	Host      string   `json:"host"`
+	Removed   []*Image `json:"removed"`
+	Reclaimed int64    `json:"reclaimed"`
+	Error     string   `json:"error,omitempty"`
+}
@@ -14,16 +14,20 @@ type ServiceInfo struct {
 	Storage          []string      `json:"storage,omitempty"`
 	CreatedAt        time.Time     `json:"createdAt"`
 	UpdatedAt        time.Time     `json:"updatedAt"`
-	Environment      string        `json:"environment"`
+	Environment      string        `json:"environment,omitempty"`
 	Version          string        `json:"version"`
+	// TES-specific fields.
+	TESResourcesBackendParameters []string `json:"tesResources_backend_parameters"`
 }
 
+// ServiceType describes the API implemented by the service.
 type ServiceType struct {
 	Group    string `json:"group"`
 	Artifact string `json:"artifact"`
 	Version  string `json:"version"`
 }
 
+// Organization describes the organization responsible for the service.
 type Organization struct {
 	Name string `json:"name"`
 	URL  string `json:"url"`
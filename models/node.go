@@ -5,11 +5,11 @@ package models
 // Host is used as its unique identifier.
 type Node struct {
 	Host   string `json:"host" bson:"_id"`
-	Port   string `json:"port"`
-	Active bool   `json:"active"`
+	Port   string `json:"port" bson:"port"`
+	Active bool   `json:"active" bson:"active"`
 
-	CPUCores int32   `json:"cpu_cores"`
-	RAMGb    float64 `json:"ram_gb"`
+	CPUCores int32   `json:"cpu_cores" bson:"cpucores"`
+	RAMGb    float64 `json:"ram_gb" bson:"ramgb"`
 
 	// Usage keeps real-time allocated resources in memory. It is not stored in database.
 	Usage *Usage `json:"usage" bson:"-"`
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// openAPI is the part of the TES OpenAPI document checked against models.
+type openAPI struct {
+	Info struct {
+		Version string `yaml:"version"`
+	} `yaml:"info"`
+	Components struct {
+		Schemas map[string]schema `yaml:"schemas"`
+	} `yaml:"components"`
+}
+
+type schema struct {
+	Properties map[string]interface{} `yaml:"properties"`
+	Enum       []string               `yaml:"enum"`
+	AllOf      []schema               `yaml:"allOf"`
+}
+
+// properties returns property names of s, including those of schemas it is composed of.
+func (s schema) properties() []string {
+	var names []string
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	for _, sub := range s.AllOf {
+		names = append(names, sub.properties()...)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func loadOpenAPI(t *testing.T) *openAPI {
+	b, err := ioutil.ReadFile("../api/task_execution_service.openapi.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc openAPI
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return &doc
+}
+
+// jsonFields returns JSON field names of struct v.
+func jsonFields(v interface{}) []string {
+	var names []string
+	typ := reflect.TypeOf(v)
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestOpenAPIVersion(t *testing.T) {
+	if v := loadOpenAPI(t).Info.Version; v != "1.1.0" {
+		t.Errorf("got TES version %s, want 1.1.0", v)
+	}
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	tests := []struct {
+		schema string
+		model  interface{}
+		// extra are RNNR fields not in TES.
+		extra []string
+	}{
+		{schema: "tesTask", model: Task{}, extra: []string{"host", "metrics", "owner"}},
+		{schema: "tesExecutor", model: Executor{}},
+		{schema: "tesExecutorLog", model: ExecutorLog{}},
+		{schema: "tesInput", model: Input{}},
+		{schema: "tesOutput", model: Output{}},
+		{schema: "tesOutputFileLog", model: OutputFileLog{}},
+		{schema: "tesResources", model: Resources{}},
+		{schema: "tesTaskLog", model: TaskLog{}},
+		{schema: "tesListTasksResponse", model: ListTasksResponse{}},
+		{schema: "tesCreateTaskResponse", model: CreateTaskResponse{}},
+		{schema: "tesCancelTaskResponse", model: CancelTaskResponse{}},
+	}
+	schemas := loadOpenAPI(t).Components.Schemas
+	for _, tt := range tests {
+		t.Run(tt.schema, func(t *testing.T) {
+			s, ok := schemas[tt.schema]
+			if !ok {
+				t.Fatalf("schema %s not found", tt.schema)
+			}
+			want := append(s.properties(), tt.extra...)
+			sort.Strings(want)
+			if got := jsonFields(tt.model); strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("got fields\n%v\nwant\n%v", got, want)
+			}
+		})
+	}
+}
+
+// TestOpenAPIServiceInfo checks TES fields of service info.
+// Fields of GA4GH service info are defined in an external schema.
+func TestOpenAPIServiceInfo(t *testing.T) {
+	got := jsonFields(ServiceInfo{})
+	for _, name := range loadOpenAPI(t).Components.Schemas["tesServiceInfo"].properties() {
+		if i := sort.SearchStrings(got, name); i == len(got) || got[i] != name {
+			t.Errorf("service info is missing %s", name)
+		}
+	}
+}
+
+func TestOpenAPIStates(t *testing.T) {
+	want := loadOpenAPI(t).Components.Schemas["tesState"].Enum
+	got := []State{Unknown, Queued, Initializing, Running, Paused, Complete, ExecutorError, SystemError, Canceled, Preempted}
+	if len(got) != len(want) {
+		t.Fatalf("got %d states, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if string(got[i]) != want[i] {
+			t.Errorf("got state %s, want %s", got[i], want[i])
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 )
@@ -28,6 +29,8 @@ const (
 	SystemError State = "SYSTEM_ERROR"
 	// Canceled means task was canceled
 	Canceled State = "CANCELED"
+	// Preempted means task was stopped by the system, it is not used
+	Preempted State = "PREEMPTED"
 )
 
 // ActiveStates returns task states considered active.
@@ -42,7 +45,12 @@ func ErrorStates() []State {
 
 // TerminatedStates returns task states considered completed.
 func TerminatedStates() []State {
-	return []State{Complete, ExecutorError, SystemError, Canceled}
+	return []State{Complete, ExecutorError, SystemError, Canceled, Preempted}
+}
+
+// Terminated returns true if state is complete, executor error, system error, canceled or preempted.
+func (s State) Terminated() bool {
+	return s == Complete || s == ExecutorError || s == SystemError || s == Canceled || s == Preempted
 }
 
 // FileType can be file or directory
@@ -57,110 +65,134 @@ const (
 
 // Input represents an input file to be used by task.
 type Input struct {
-	Name        string   `json:"name,omitempty"`
-	Description string   `json:"description,omitempty"`
-	URL         string   `json:"url"`
-	Path        string   `json:"path"`
-	Type        FileType `json:"type"`
-	Content     string   `json:"content,omitempty"`
+	Name        string   `json:"name,omitempty" bson:"name"`
+	Description string   `json:"description,omitempty" bson:"description"`
+	URL         string   `json:"url" bson:"url"`
+	Path        string   `json:"path" bson:"path"`
+	Type        FileType `json:"type" bson:"type"`
+	Content     string   `json:"content,omitempty" bson:"content"`
+	// Input may be streamed instead of being fully available before the task starts
+	Streamable bool `json:"streamable,omitempty" bson:"streamable"`
 }
 
 // Output represents a file generated by task
 type Output struct {
-	Name        string   `json:"name,omitempty"`
-	Description string   `json:"description,omitempty"`
-	URL         string   `json:"url"`
-	Path        string   `json:"path"`
-	Type        FileType `json:"type"`
+	Name        string   `json:"name,omitempty" bson:"name"`
+	Description string   `json:"description,omitempty" bson:"description"`
+	URL         string   `json:"url" bson:"url"`
+	Path        string   `json:"path" bson:"path"`
+	Type        FileType `json:"type" bson:"type"`
+	// Prefix removed from output paths when path contains wildcards
+	PathPrefix string `json:"path_prefix,omitempty" bson:"pathprefix"`
 }
 
 // Resources represents computing requirements to run task
 type Resources struct {
-	CPUCores    int32    `json:"cpu_cores,omitempty"`
-	RAMGb       float64  `json:"ram_gb,omitempty"`
-	DiskGb      float64  `json:"disk_gb,omitempty"`
-	Zones       []string `json:"zones,omitempty"`
-	Preemptible bool     `json:"preemptible,omitempty"`
+	CPUCores    int32    `json:"cpu_cores,omitempty" bson:"cpucores"`
+	RAMGb       float64  `json:"ram_gb,omitempty" bson:"ramgb"`
+	DiskGb      float64  `json:"disk_gb,omitempty" bson:"diskgb"`
+	Zones       []string `json:"zones,omitempty" bson:"zones"`
+	Preemptible bool     `json:"preemptible,omitempty" bson:"preemptible"`
+	// Backend-specific parameters. Unsupported parameters are ignored unless BackendParametersStrict is true
+	BackendParameters       map[string]string `json:"backend_parameters,omitempty" bson:"backendparameters"`
+	BackendParametersStrict bool              `json:"backend_parameters_strict,omitempty" bson:"backendparametersstrict"`
 }
 
 // Executor describes a command to be executed, and its environment.
 type Executor struct {
 	// Name of the container image
-	Image string `json:"image"`
+	Image string `json:"image" bson:"image"`
 	// A sequence of program arguments to execute, where the first argument is the program to execute
-	Command []string `json:"command"`
+	Command []string `json:"command" bson:"command"`
 	// The working directory that the command will be executed in
-	WorkDir string `json:"workdir,omitempty"`
+	WorkDir string `json:"workdir,omitempty" bson:"workdir"`
 	// Path inside the container to a file which will be piped to the executor's stdin
-	Stdin string `json:"stdin,omitempty"`
+	Stdin string `json:"stdin,omitempty" bson:"stdin"`
 	// Path inside the container to a file where the executor's stdout will be written to
-	Stdout string `json:"stdout,omitempty"`
+	Stdout string `json:"stdout,omitempty" bson:"stdout"`
 	// Path inside the container to a file where the executor's stderr will be written to
-	Stderr string `json:"stderr,omitempty"`
+	Stderr string `json:"stderr,omitempty" bson:"stderr"`
 	// Environment variables to set within the container
-	Env map[string]string `json:"env,omitempty"`
+	Env map[string]string `json:"env,omitempty" bson:"env"`
+	// Task is not considered failed if executor exits with non-zero code
+	IgnoreError bool `json:"ignore_error,omitempty" bson:"ignoreerror"`
 }
 
 // ExecutorLog represents processing times and logs of an executor
 type ExecutorLog struct {
-	ExitCode  int32     `json:"exit_code"`            // Exit code
-	StartTime time.Time `json:"start_time,omitempty"` // Time the executor started
-	EndTime   time.Time `json:"end_time,omitempty"`   // Time the executor ended
-	Stdout    string    `json:"stdout,omitempty"`     // Stdout content
-	Stderr    string    `json:"stderr,omitempty"`     // Stderr content
+	ExitCode  int32     `json:"exit_code" bson:"exitcode"`             // Exit code
+	StartTime time.Time `json:"start_time,omitempty" bson:"starttime"` // Time the executor started
+	EndTime   time.Time `json:"end_time,omitempty" bson:"endtime"`     // Time the executor ended
+	Stdout    string    `json:"stdout,omitempty" bson:"stdout"`        // Stdout content
+	Stderr    string    `json:"stderr,omitempty" bson:"stderr"`        // Stderr content
 }
 
 // OutputFileLog represents a log file
 type OutputFileLog struct {
-	URL       string `json:"url"`
-	Path      string `json:"path"`
-	SizeBytes string `json:"size_bytes"`
+	URL       string `json:"url" bson:"url"`
+	Path      string `json:"path" bson:"path"`
+	SizeBytes string `json:"size_bytes" bson:"sizebytes"`
 }
 
 // TaskLog represents processing times and logs of a task
 type TaskLog struct {
 	// ExecutorLogs for each executor
-	ExecutorLogs []*ExecutorLog `json:"logs,omitempty"`
+	ExecutorLogs []*ExecutorLog `json:"logs" bson:"executorlogs"`
 	// Arbitrary logging metadata included by the implementation
-	Metadata map[string]string `json:"metadata,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty" bson:"metadata"`
 	// When the task started
-	StartTime *time.Time `json:"start_time,omitempty"`
+	StartTime *time.Time `json:"start_time,omitempty" bson:"starttime"`
 	// When the task ended
-	EndTime *time.Time `json:"end_time,omitempty"`
+	EndTime *time.Time `json:"end_time,omitempty" bson:"endtime"`
 	// Information about all output files
-	Outputs []*OutputFileLog `json:"outputs,omitempty"`
+	Outputs []*OutputFileLog `json:"outputs" bson:"outputs"`
 	// System logs are any logs the system decides are relevant, which are not tied directly to an Executor process
-	SystemLogs []string `json:"system_logs,omitempty"`
+	SystemLogs []string `json:"system_logs,omitempty" bson:"systemlogs"`
+}
+
+// MarshalJSON encodes task log with empty arrays instead of null, as required by TES.
+func (l *TaskLog) MarshalJSON() ([]byte, error) {
+	type taskLog TaskLog
+	v := taskLog(*l)
+	if v.ExecutorLogs == nil {
+		v.ExecutorLogs = []*ExecutorLog{}
+	}
+	if v.Outputs == nil {
+		v.Outputs = []*OutputFileLog{}
+	}
+	return json.Marshal(&v)
 }
 
 // Metrics represents a active computing node.
 type Metrics struct {
 	// Total CPU time in nanoseconds across all cores.
-	CPUTime uint64 `json:"cpu_time"`
+	CPUTime uint64 `json:"cpu_time" bson:"cputime"`
 	// Maximum CPU percentage ever recorded.
-	CPUPercentage float64 `json:"cpu_percentage"`
+	CPUPercentage float64 `json:"cpu_percentage" bson:"cpupercentage"`
 	// Maximum memory used ever recorded in bytes.
-	Memory uint64 `json:"memory"`
+	Memory uint64 `json:"memory" bson:"memory"`
 }
 
-// Task is a collection of command to be executed to process data
+// Task is a collection of command to be executed to process data.
+// BSON field names are the lowercase Go field names, which is how tasks were stored before they were explicitly defined.
 type Task struct {
 	ID          string            `json:"id" bson:"_id"`
-	State       State             `json:"state"`
-	Name        string            `json:"name,omitempty"`
-	Description string            `json:"description,omitempty"`
-	Created     *time.Time        `json:"creation_time,omitempty"`
-	Resources   *Resources        `json:"resources,omitempty"`
-	Executors   []Executor        `json:"executors,omitempty"`
-	Inputs      []*Input          `json:"inputs,omitempty"`
-	Outputs     []*Output         `json:"outputs,omitempty"`
-	Volumes     []string          `json:"volumes,omitempty"`
-	Tags        map[string]string `json:"tags,omitempty"`
-	Logs        []*TaskLog        `json:"logs,omitempty"`
+	State       State             `json:"state" bson:"state"`
+	Name        string            `json:"name,omitempty" bson:"name"`
+	Description string            `json:"description,omitempty" bson:"description"`
+	Created     *time.Time        `json:"creation_time,omitempty" bson:"created"`
+	Resources   *Resources        `json:"resources,omitempty" bson:"resources"`
+	Executors   []Executor        `json:"executors,omitempty" bson:"executors"`
+	Inputs      []*Input          `json:"inputs,omitempty" bson:"inputs"`
+	Outputs     []*Output         `json:"outputs,omitempty" bson:"outputs"`
+	Volumes     []string          `json:"volumes,omitempty" bson:"volumes"`
+	Tags        map[string]string `json:"tags,omitempty" bson:"tags"`
+	Logs        []*TaskLog        `json:"logs,omitempty" bson:"logs"`
 
 	// RNNR specific fields.
-	Host    string   `json:"host,omitempty"`
-	Metrics *Metrics `json:"metrics,omitempty"`
+	Owner   string   `json:"owner,omitempty" bson:"owner"`
+	Host    string   `json:"host,omitempty" bson:"host"`
+	Metrics *Metrics `json:"metrics,omitempty" bson:"metrics"`
 }
 
 // ListTasksResponse represents a list of tasks previous submitted to system
@@ -169,6 +201,21 @@ type ListTasksResponse struct {
 	NextPageToken string  `json:"next_page_token,omitempty"`
 }
 
+// TaskFilter selects tasks to be listed.
+// Empty fields do not filter tasks.
+type TaskFilter struct {
+	// Tasks whose name starts with this prefix
+	NamePrefix string
+	// Tasks assigned to any of these worker nodes
+	Nodes []string
+	// Tasks in any of these states
+	States []State
+	// Tasks that have all these tags. Empty value matches any value of the tag
+	Tags map[string]string
+	// Tasks created by this user
+	Owner string
+}
+
 // CreateTaskResponse represents a task submitted and approved by the system
 type CreateTaskResponse struct {
 	ID string `json:"id"`
@@ -178,6 +225,19 @@ type CreateTaskResponse struct {
 type CancelTaskResponse struct {
 }
 
+// PurgeTasksRequest selects terminated tasks to be deleted.
+type PurgeTasksRequest struct {
+	// Tasks that ended before this time are deleted
+	Before time.Time `json:"before"`
+	// States of tasks to be deleted, all terminated states if empty
+	States []State `json:"states,omitempty"`
+}
+
+// PurgeTasksResponse has the number of deleted tasks
+type PurgeTasksResponse struct {
+	Deleted int64 `json:"deleted"`
+}
+
 // View defines which task field should be returned
 type View string
 
@@ -185,10 +245,10 @@ const (
 	// Minimal returns only task ID and state
 	Minimal View = "MINIMAL"
 	// Basic returns all fields except
-	// - Logs.ExecutorLogs.Stdout
-	// - Logs.ExecutorLogs.Stderr
-	// - Inputs.Content
-	// - Logs.SystemLogs
+	// - logs.logs.stdout
+	// - logs.logs.stderr
+	// - inputs.content
+	// - logs.system_logs
 	Basic View = "BASIC"
 	// Full returns all fields
 	Full View = "FULL"
@@ -204,9 +264,9 @@ func (t *Task) Failed() bool {
 	return t.State == ExecutorError || t.State == SystemError
 }
 
-// Terminated returns true if task is completed (complete, executor error, system error and canceled).
+// Terminated returns true if task is completed (complete, executor error, system error, canceled and preempted).
 func (t *Task) Terminated() bool {
-	return t.State == Complete || t.State == ExecutorError || t.State == SystemError || t.State == Canceled
+	return t.State.Terminated()
 }
 
 func (t *Task) String() string {
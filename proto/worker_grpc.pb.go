@@ -23,6 +23,14 @@ type WorkerClient interface {
 	RunContainer(ctx context.Context, in *Container, opts ...grpc.CallOption) (*empty.Empty, error)
 	CheckContainer(ctx context.Context, in *Container, opts ...grpc.CallOption) (*State, error)
 	StopContainer(ctx context.Context, in *Container, opts ...grpc.CallOption) (*empty.Empty, error)
+	CheckContainers(ctx context.Context, in *ContainerIds, opts ...grpc.CallOption) (*States, error)
+	WatchContainers(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (Worker_WatchContainersClient, error)
+	StreamLogs(ctx context.Context, in *LogsRequest, opts ...grpc.CallOption) (Worker_StreamLogsClient, error)
+	Exec(ctx context.Context, opts ...grpc.CallOption) (Worker_ExecClient, error)
+	Reconcile(ctx context.Context, in *ActiveTasks, opts ...grpc.CallOption) (*Reconciled, error)
+	PullImage(ctx context.Context, in *PullRequest, opts ...grpc.CallOption) (Worker_PullImageClient, error)
+	ListImages(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*Images, error)
+	PruneImages(ctx context.Context, in *PruneRequest, opts ...grpc.CallOption) (*Pruned, error)
 }
 
 type workerClient struct {
@@ -69,6 +77,169 @@ func (c *workerClient) StopContainer(ctx context.Context, in *Container, opts ..
 	return out, nil
 }
 
+func (c *workerClient) CheckContainers(ctx context.Context, in *ContainerIds, opts ...grpc.CallOption) (*States, error) {
+	out := new(States)
+	err := c.cc.Invoke(ctx, "/proto.Worker/CheckContainers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *workerClient) WatchContainers(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (Worker_WatchContainersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Worker_ServiceDesc.Streams[0], "/proto.Worker/WatchContainers", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &workerWatchContainersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Worker_WatchContainersClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type workerWatchContainersClient struct {
+	grpc.ClientStream
+}
+
+func (x *workerWatchContainersClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *workerClient) StreamLogs(ctx context.Context, in *LogsRequest, opts ...grpc.CallOption) (Worker_StreamLogsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Worker_ServiceDesc.Streams[1], "/proto.Worker/StreamLogs", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &workerStreamLogsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Worker_StreamLogsClient interface {
+	Recv() (*LogChunk, error)
+	grpc.ClientStream
+}
+
+type workerStreamLogsClient struct {
+	grpc.ClientStream
+}
+
+func (x *workerStreamLogsClient) Recv() (*LogChunk, error) {
+	m := new(LogChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *workerClient) Exec(ctx context.Context, opts ...grpc.CallOption) (Worker_ExecClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Worker_ServiceDesc.Streams[2], "/proto.Worker/Exec", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &workerExecClient{stream}
+	return x, nil
+}
+
+type Worker_ExecClient interface {
+	Send(*ExecInput) error
+	Recv() (*ExecOutput, error)
+	grpc.ClientStream
+}
+
+type workerExecClient struct {
+	grpc.ClientStream
+}
+
+func (x *workerExecClient) Send(m *ExecInput) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *workerExecClient) Recv() (*ExecOutput, error) {
+	m := new(ExecOutput)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *workerClient) Reconcile(ctx context.Context, in *ActiveTasks, opts ...grpc.CallOption) (*Reconciled, error) {
+	out := new(Reconciled)
+	err := c.cc.Invoke(ctx, "/proto.Worker/Reconcile", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *workerClient) PullImage(ctx context.Context, in *PullRequest, opts ...grpc.CallOption) (Worker_PullImageClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Worker_ServiceDesc.Streams[3], "/proto.Worker/PullImage", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &workerPullImageClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Worker_PullImageClient interface {
+	Recv() (*PullProgress, error)
+	grpc.ClientStream
+}
+
+type workerPullImageClient struct {
+	grpc.ClientStream
+}
+
+func (x *workerPullImageClient) Recv() (*PullProgress, error) {
+	m := new(PullProgress)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *workerClient) ListImages(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*Images, error) {
+	out := new(Images)
+	err := c.cc.Invoke(ctx, "/proto.Worker/ListImages", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *workerClient) PruneImages(ctx context.Context, in *PruneRequest, opts ...grpc.CallOption) (*Pruned, error) {
+	out := new(Pruned)
+	err := c.cc.Invoke(ctx, "/proto.Worker/PruneImages", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // WorkerServer is the server API for Worker service.
 // All implementations must embed UnimplementedWorkerServer
 // for forward compatibility
@@ -77,6 +248,14 @@ type WorkerServer interface {
 	RunContainer(context.Context, *Container) (*empty.Empty, error)
 	CheckContainer(context.Context, *Container) (*State, error)
 	StopContainer(context.Context, *Container) (*empty.Empty, error)
+	CheckContainers(context.Context, *ContainerIds) (*States, error)
+	WatchContainers(*empty.Empty, Worker_WatchContainersServer) error
+	StreamLogs(*LogsRequest, Worker_StreamLogsServer) error
+	Exec(Worker_ExecServer) error
+	Reconcile(context.Context, *ActiveTasks) (*Reconciled, error)
+	PullImage(*PullRequest, Worker_PullImageServer) error
+	ListImages(context.Context, *empty.Empty) (*Images, error)
+	PruneImages(context.Context, *PruneRequest) (*Pruned, error)
 	mustEmbedUnimplementedWorkerServer()
 }
 
@@ -96,6 +275,30 @@ func (UnimplementedWorkerServer) CheckContainer(context.Context, *Container) (*S
 func (UnimplementedWorkerServer) StopContainer(context.Context, *Container) (*empty.Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method StopContainer not implemented")
 }
+func (UnimplementedWorkerServer) CheckContainers(context.Context, *ContainerIds) (*States, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CheckContainers not implemented")
+}
+func (UnimplementedWorkerServer) WatchContainers(*empty.Empty, Worker_WatchContainersServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchContainers not implemented")
+}
+func (UnimplementedWorkerServer) StreamLogs(*LogsRequest, Worker_StreamLogsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamLogs not implemented")
+}
+func (UnimplementedWorkerServer) Exec(Worker_ExecServer) error {
+	return status.Errorf(codes.Unimplemented, "method Exec not implemented")
+}
+func (UnimplementedWorkerServer) Reconcile(context.Context, *ActiveTasks) (*Reconciled, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reconcile not implemented")
+}
+func (UnimplementedWorkerServer) PullImage(*PullRequest, Worker_PullImageServer) error {
+	return status.Errorf(codes.Unimplemented, "method PullImage not implemented")
+}
+func (UnimplementedWorkerServer) ListImages(context.Context, *empty.Empty) (*Images, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListImages not implemented")
+}
+func (UnimplementedWorkerServer) PruneImages(context.Context, *PruneRequest) (*Pruned, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PruneImages not implemented")
+}
 func (UnimplementedWorkerServer) mustEmbedUnimplementedWorkerServer() {}
 
 // UnsafeWorkerServer may be embedded to opt out of forward compatibility for this service.
@@ -181,6 +384,167 @@ func _Worker_StopContainer_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Worker_CheckContainers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ContainerIds)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkerServer).CheckContainers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Worker/CheckContainers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkerServer).CheckContainers(ctx, req.(*ContainerIds))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Worker_WatchContainers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(empty.Empty)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(WorkerServer).WatchContainers(m, &workerWatchContainersServer{stream})
+}
+
+type Worker_WatchContainersServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type workerWatchContainersServer struct {
+	grpc.ServerStream
+}
+
+func (x *workerWatchContainersServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Worker_StreamLogs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(LogsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(WorkerServer).StreamLogs(m, &workerStreamLogsServer{stream})
+}
+
+type Worker_StreamLogsServer interface {
+	Send(*LogChunk) error
+	grpc.ServerStream
+}
+
+type workerStreamLogsServer struct {
+	grpc.ServerStream
+}
+
+func (x *workerStreamLogsServer) Send(m *LogChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Worker_Exec_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(WorkerServer).Exec(&workerExecServer{stream})
+}
+
+type Worker_ExecServer interface {
+	Send(*ExecOutput) error
+	Recv() (*ExecInput, error)
+	grpc.ServerStream
+}
+
+type workerExecServer struct {
+	grpc.ServerStream
+}
+
+func (x *workerExecServer) Send(m *ExecOutput) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *workerExecServer) Recv() (*ExecInput, error) {
+	m := new(ExecInput)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Worker_Reconcile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ActiveTasks)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkerServer).Reconcile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Worker/Reconcile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkerServer).Reconcile(ctx, req.(*ActiveTasks))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Worker_PullImage_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PullRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(WorkerServer).PullImage(m, &workerPullImageServer{stream})
+}
+
+type Worker_PullImageServer interface {
+	Send(*PullProgress) error
+	grpc.ServerStream
+}
+
+type workerPullImageServer struct {
+	grpc.ServerStream
+}
+
+func (x *workerPullImageServer) Send(m *PullProgress) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Worker_ListImages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(empty.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkerServer).ListImages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Worker/ListImages",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkerServer).ListImages(ctx, req.(*empty.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Worker_PruneImages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PruneRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkerServer).PruneImages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/proto.Worker/PruneImages",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkerServer).PruneImages(ctx, req.(*PruneRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Worker_ServiceDesc is the grpc.ServiceDesc for Worker service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -204,7 +568,45 @@ var Worker_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "StopContainer",
 			Handler:    _Worker_StopContainer_Handler,
 		},
+		{
+			MethodName: "CheckContainers",
+			Handler:    _Worker_CheckContainers_Handler,
+		},
+		{
+			MethodName: "Reconcile",
+			Handler:    _Worker_Reconcile_Handler,
+		},
+		{
+			MethodName: "ListImages",
+			Handler:    _Worker_ListImages_Handler,
+		},
+		{
+			MethodName: "PruneImages",
+			Handler:    _Worker_PruneImages_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchContainers",
+			Handler:       _Worker_WatchContainers_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamLogs",
+			Handler:       _Worker_StreamLogs_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Exec",
+			Handler:       _Worker_Exec_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "PullImage",
+			Handler:       _Worker_PullImage_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/worker.proto",
 }
@@ -0,0 +1,288 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/labbcb/rnnr/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Apptainer runs containers with apptainer exec (or singularity exec), for nodes without a container daemon.
+// Docker images are converted to SIF images once and cached.
+// Containers run as the worker user.
+type Apptainer struct {
+	*processes
+	binary   string
+	images   string
+	cgroups  string
+	volumes  []string
+	auths    *RegistryAuths
+	security SecurityProfile
+
+	// pulls serializes conversions of each image.
+	pulls sync.Map
+}
+
+// ApptainerConnect finds apptainer or singularity executable.
+// Containers and converted images are kept in dir.
+// Registry credentials are used to pull Docker images.
+// Containers are hardened with security profile as far as Apptainer supports it.
+func ApptainerConnect(dir string, volumes []string, auths *RegistryAuths, security SecurityProfile) (*Apptainer, error) {
+	binary, err := exec.LookPath("apptainer")
+	if err != nil {
+		if binary, err = exec.LookPath("singularity"); err != nil {
+			return nil, errors.New("apptainer or singularity executable not found")
+		}
+	}
+
+	p, err := newProcesses(filepath.Join(dir, "containers"))
+	if err != nil {
+		return nil, err
+	}
+	a := &Apptainer{processes: p, binary: binary, images: filepath.Join(dir, "images"), volumes: volumes, auths: auths, security: security}
+	if err := os.MkdirAll(a.images, 0700); err != nil {
+		return nil, err
+	}
+
+	// Root can place each container in its own cgroup, so its usage is measured apart from worker.
+	if os.Geteuid() == 0 {
+		a.cgroups = filepath.Join(dir, "cgroups.toml")
+		if err := ioutil.WriteFile(a.cgroups, []byte("# Resources are not limited, cgroups only measure usage.\n"), 0600); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Run converts image according to container pull policy and starts apptainer exec.
+// Inputs and outputs are bind-mounted like Docker mounts.
+func (a *Apptainer) Run(ctx context.Context, container *proto.Container) error {
+	binds, err := mounts(a.volumes, container)
+	if err != nil {
+		return err
+	}
+	image, err := a.pullImage(ctx, container.Image, PullPolicy(container.PullPolicy))
+	if err != nil {
+		return fmt.Errorf("unable to pull image %s: %w", container.Image, err)
+	}
+
+	command := []string{a.binary, "exec", "--cleanenv"}
+	if a.cgroups != "" {
+		command = append(command, "--apply-cgroups", a.cgroups)
+	}
+	if container.WorkDir != "" {
+		command = append(command, "--pwd", container.WorkDir)
+	}
+	command = append(command, a.securityFlags(container.Security)...)
+	if container.User != "" {
+		// Only root can run containers as other users.
+		if os.Geteuid() != 0 {
+			return errors.New("apptainer runtime runs containers as other users only if worker runs as root")
+		}
+		uid, gid, err := parseUser(container.User)
+		if err != nil {
+			return err
+		}
+		command = append(command, "--security", fmt.Sprintf("uid:%d,gid:%d", uid, gid))
+	}
+	for _, m := range binds {
+		bind := m.Source + ":" + m.Target
+		if m.ReadOnly {
+			bind += ":ro"
+		}
+		command = append(command, "--bind", bind)
+	}
+	for k, v := range container.Env {
+		command = append(command, "--env", k+"="+v)
+	}
+	for _, v := range scratchEnv(container, ScratchPath) {
+		command = append(command, "--env", v)
+	}
+	command = append(command, image)
+	command = append(command, container.Command...)
+
+	if err := a.start(container.Id, processSpec{command: command, env: os.Environ()}); err != nil {
+		return err
+	}
+	// Images of containers are in use and not pruned.
+	return ioutil.WriteFile(a.path(container.Id, "image"), []byte(image), 0600)
+}
+
+// securityFlags returns apptainer exec flags of worker security profile and container relaxations.
+// SIF root filesystems are read-only and Apptainer always sets no-new-privileges.
+// Capabilities, seccomp and AppArmor profiles are only applied if worker runs as root.
+func (a *Apptainer) securityFlags(security *proto.Security) []string {
+	if security == nil {
+		security = &proto.Security{}
+	}
+	var flags []string
+	if a.security.NetworkNone && !security.Network {
+		flags = append(flags, "--net", "--network", "none")
+	}
+	if len(security.Capabilities) > 0 {
+		flags = append(flags, "--add-caps", strings.Join(security.Capabilities, ","))
+	} else if a.security.DropCapabilities {
+		flags = append(flags, "--no-privs")
+	}
+	if security.WritableRootfs {
+		flags = append(flags, "--writable-tmpfs")
+	}
+	if a.security.Seccomp != "" {
+		flags = append(flags, "--security", "seccomp:"+a.security.Seccomp)
+	}
+	if a.security.AppArmor != "" {
+		flags = append(flags, "--security", "apparmor:"+a.security.AppArmor)
+	}
+	return flags
+}
+
+// Exec is not supported because apptainer exec containers cannot be joined.
+func (a *Apptainer) Exec(context.Context, string, []string, uint, uint) (ExecSession, error) {
+	return nil, status.Error(codes.Unimplemented, "apptainer runtime does not support executing commands in containers")
+}
+
+// Pull converts image to a cached SIF image according to policy.
+// Apptainer does not report download progress, only when conversion starts and ends.
+// Only images referenced by digest have a known digest.
+func (a *Apptainer) Pull(ctx context.Context, image string, policy PullPolicy, progress func(*proto.PullProgress)) (string, error) {
+	if progress != nil {
+		progress(&proto.PullProgress{Status: "Converting image"})
+	}
+	if _, err := a.pullImage(ctx, image, policy); err != nil {
+		return "", err
+	}
+	if progress != nil {
+		progress(&proto.PullProgress{Status: "Image is up to date"})
+	}
+	return repoDigest(strings.TrimPrefix(image, "docker://"), nil), nil
+}
+
+// pullImage returns the SIF file of image, converting it according to policy.
+// Local SIF files are used as they are. Images without a transport (docker://, library://, oras://) are Docker images.
+func (a *Apptainer) pullImage(ctx context.Context, image string, policy PullPolicy) (string, error) {
+	if strings.HasSuffix(image, ".sif") && !strings.Contains(image, "://") {
+		return image, nil
+	}
+	source := image
+	if !strings.Contains(source, "://") {
+		source = "docker://" + source
+	}
+
+	file := filepath.Join(a.images, sifName(source))
+	mu, _ := a.pulls.LoadOrStore(file, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	if _, err := os.Stat(file); err == nil && policy != PullAlways {
+		return file, a.writeRef(file, image)
+	}
+	if policy == PullNever {
+		return "", fmt.Errorf("image %s is not converted and pull policy is %s", image, policy)
+	}
+
+	cmd := exec.CommandContext(ctx, a.binary, "pull", "--force", file+".tmp", source)
+	cmd.Env = os.Environ()
+	if strings.HasPrefix(source, "docker://") {
+		auth, err := a.auths.lookup(strings.TrimPrefix(source, "docker://"))
+		if err != nil {
+			return "", err
+		}
+		if auth.Username != "" {
+			for _, prefix := range []string{"APPTAINER", "SINGULARITY"} {
+				cmd.Env = append(cmd.Env, prefix+"_DOCKER_USERNAME="+auth.Username, prefix+"_DOCKER_PASSWORD="+auth.Password)
+			}
+		}
+	}
+
+	log.WithField("image", source).Info("Converting image.")
+	tmp := file + ".tmp"
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return "", err
+	}
+	return file, a.writeRef(file, image)
+}
+
+// writeRef keeps the reference of image next to its SIF file, if it was not kept yet, to list cached images.
+func (a *Apptainer) writeRef(file, image string) error {
+	if _, err := os.Stat(file + ".ref"); err == nil {
+		return nil
+	}
+	return ioutil.WriteFile(file+".ref", []byte(imageRef(image)), 0600)
+}
+
+// Images lists converted images. Images of containers not removed yet are in use.
+func (a *Apptainer) Images(context.Context) ([]*proto.Image, error) {
+	used := make(map[string]bool)
+	ids, err := a.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if b, err := ioutil.ReadFile(a.path(id, "image")); err == nil {
+			used[string(b)] = true
+		}
+	}
+
+	infos, err := ioutil.ReadDir(a.images)
+	if err != nil {
+		return nil, err
+	}
+	var images []*proto.Image
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".sif") {
+			continue
+		}
+		file := filepath.Join(a.images, info.Name())
+		image := &proto.Image{Id: info.Name(), Size: info.Size(), InUse: used[file]}
+		if b, err := ioutil.ReadFile(file + ".ref"); err == nil {
+			image.References = []string{string(b)}
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// RemoveImage removes a converted image by its file name.
+func (a *Apptainer) RemoveImage(_ context.Context, id string) error {
+	file := filepath.Join(a.images, filepath.Base(id))
+	mu, _ := a.pulls.LoadOrStore(file, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	if err := os.Remove(file); err != nil {
+		return err
+	}
+	if err := os.Remove(file + ".ref"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// sifName returns a readable and unique file name of an image.
+func sifName(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return fmt.Sprintf("%s-%x.sif", unsafeFileChars.ReplaceAllString(source, "_"), sum[:4])
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import "errors"
+
+// ApptainerConnect fails because Apptainer only runs on Linux.
+func ApptainerConnect(string, []string, *RegistryAuths, SecurityProfile) (Runtime, error) {
+	return nil, errors.New("apptainer runtime requires Linux")
+}
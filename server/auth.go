@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/golang-jwt/jwt/v4"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrNoCredentials is returned by an Authenticator when request does not have credentials it can verify.
+var ErrNoCredentials = errors.New("no credentials")
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Name string
+}
+
+// Authenticator identifies the caller of HTTP requests.
+type Authenticator interface {
+	// Authenticate returns the caller identity.
+	// It returns ErrNoCredentials if request does not have credentials supported by the authenticator,
+	// or other error if credentials are invalid.
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+type identityKey struct{}
+
+// RequestIdentity returns the authenticated caller of a request, or nil if authentication is disabled.
+func RequestIdentity(r *http.Request) *Identity {
+	id, _ := r.Context().Value(identityKey{}).(*Identity)
+	return id
+}
+
+// authenticate is a middleware that rejects requests not authenticated by any of Main.Authenticators.
+// Service info is always public. Authentication is disabled if there is no authenticator.
+func (m *Main) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(m.Authenticators) == 0 || r.URL.Path == "/ga4gh/tes/v1/service-info" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, a := range m.Authenticators {
+			id, err := a.Authenticate(r)
+			switch err {
+			case nil:
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+				return
+			case ErrNoCredentials:
+				continue
+			default:
+				log.WithFields(log.Fields{"remote": r.RemoteAddr, "path": r.URL.Path, "error": err}).Warn("Authentication failed.")
+				unauthorized(w)
+				return
+			}
+		}
+
+		unauthorized(w)
+	})
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Add("WWW-Authenticate", `Bearer realm="rnnr"`)
+	w.Header().Add("WWW-Authenticate", `Basic realm="rnnr"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// bearerToken returns the token of a bearer Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(h[7:]), true
+}
+
+// TokenAuth authenticates requests with static bearer tokens.
+type TokenAuth struct {
+	// tokens maps token to user name.
+	tokens map[string]string
+}
+
+// NewTokenAuth reads static tokens from file.
+// Each line has a user name and its token separated by white space.
+// Empty lines and lines starting with # are ignored.
+func NewTokenAuth(file string) (*TokenAuth, error) {
+	lines, err := readLines(file)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[string]string)
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: expected user name and token in each line", file)
+		}
+		tokens[fields[1]] = fields[0]
+	}
+	return &TokenAuth{tokens}, nil
+}
+
+// Authenticate identifies user by bearer token.
+func (a *TokenAuth) Authenticate(r *http.Request) (*Identity, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	for t, name := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return &Identity{Name: name}, nil
+		}
+	}
+	// Token may be a JWT verified by another authenticator.
+	return nil, ErrNoCredentials
+}
+
+// BasicAuth authenticates requests with HTTP basic authentication.
+type BasicAuth struct {
+	// hashes maps user name to password hash.
+	hashes map[string]string
+}
+
+// NewBasicAuth reads users from htpasswd file.
+// Supported password hashes are bcrypt and SHA1.
+func NewBasicAuth(file string) (*BasicAuth, error) {
+	lines, err := readLines(file)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]string)
+	for _, line := range lines {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: expected user:hash in each line", file)
+		}
+		hash := fields[1]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return nil, fmt.Errorf("%s: unsupported hash for user %s, use bcrypt (htpasswd -B)", file, fields[0])
+		}
+		hashes[fields[0]] = hash
+	}
+	return &BasicAuth{hashes}, nil
+}
+
+// Authenticate identifies user by user name and password.
+func (a *BasicAuth) Authenticate(r *http.Request) (*Identity, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	hash, ok := a.hashes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown user %s", name)
+	}
+
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		if subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(base64.StdEncoding.EncodeToString(sum[:]))) != 1 {
+			return nil, fmt.Errorf("invalid password for user %s", name)
+		}
+	} else if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return nil, fmt.Errorf("invalid password for user %s", name)
+	}
+	return &Identity{Name: name}, nil
+}
+
+// JWTAuth authenticates requests with JSON Web Tokens signed by keys of a JSON Web Key Set.
+type JWTAuth struct {
+	jwks     *keyfunc.JWKS
+	issuer   string
+	audience string
+}
+
+// NewJWTAuth reads JSON Web Key Set from file.
+// If issuer or audience are not empty tokens must have the same iss or aud claims.
+// User name is the sub claim.
+func NewJWTAuth(file, issuer, audience string) (*JWTAuth, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	jwks, err := keyfunc.NewJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing JWKS file %s: %w", file, err)
+	}
+	return &JWTAuth{jwks: jwks, issuer: issuer, audience: audience}, nil
+}
+
+// Authenticate identifies user by the subject of a bearer JWT.
+func (a *JWTAuth) Authenticate(r *http.Request) (*Identity, error) {
+	raw, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+
+	var claims jwt.RegisteredClaims
+	if _, err := jwt.ParseWithClaims(raw, &claims, a.jwks.Keyfunc); err != nil {
+		return nil, err
+	}
+	if a.issuer != "" && !claims.VerifyIssuer(a.issuer, true) {
+		return nil, fmt.Errorf("invalid token issuer %s", claims.Issuer)
+	}
+	if a.audience != "" && !claims.VerifyAudience(a.audience, true) {
+		return nil, fmt.Errorf("invalid token audience %v", claims.Audience)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token without subject")
+	}
+	return &Identity{Name: claims.Subject}, nil
+}
+
+// CertificateAuth authenticates requests with TLS client certificates verified by the HTTPS server.
+// User name is the certificate common name.
+type CertificateAuth struct{}
+
+// Authenticate identifies user by the verified client certificate.
+func (CertificateAuth) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		return nil, errors.New("client certificate without common name")
+	}
+	return &Identity{Name: name}, nil
+}
+
+// readLines reads non-empty lines that do not start with #.
+func readLines(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.WithError(err).Warn("Unable to close file.")
+		}
+	}()
+
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, s.Err()
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		ok     bool
+	}{
+		{header: "Bearer abc", want: "abc", ok: true},
+		{header: "bearer abc ", want: "abc", ok: true},
+		{header: "Bearer ", want: "", ok: true},
+		{header: "Basic YWxpY2U6c2VjcmV0"},
+		{header: "Bearer"},
+		{header: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got, ok := bearerToken(request("Authorization", tt.header))
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("got %q %t, want %q %t", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	a, err := NewTokenAuth(writeFile(t, "# user token\nalice a1b2c3\n\nbob d4e5f6\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		header string
+		want   string
+		err    error
+	}{
+		{name: "first user", header: "Bearer a1b2c3", want: "alice"},
+		{name: "second user", header: "Bearer d4e5f6", want: "bob"},
+		{name: "unknown token may be a JWT", header: "Bearer xyz", err: ErrNoCredentials},
+		{name: "user name is not a token", header: "Bearer alice", err: ErrNoCredentials},
+		{name: "basic authentication", header: "Basic YWxpY2U6c2VjcmV0", err: ErrNoCredentials},
+		{name: "no credentials", err: ErrNoCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkIdentity(t, a, request("Authorization", tt.header), tt.want, tt.err)
+		})
+	}
+}
+
+func TestNewTokenAuthInvalid(t *testing.T) {
+	for _, content := range []string{"alice\n", "alice a1b2c3 extra\n"} {
+		if _, err := NewTokenAuth(writeFile(t, content)); err == nil {
+			t.Errorf("got no error reading %q", content)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("secret"))
+	file := writeFile(t, "alice:"+string(hash)+"\nbob:{SHA}"+base64.StdEncoding.EncodeToString(sum[:])+"\n")
+	a, err := NewBasicAuth(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		user, password string
+		want           string
+		fail           bool
+	}{
+		{name: "bcrypt", user: "alice", password: "secret", want: "alice"},
+		{name: "bcrypt wrong password", user: "alice", password: "guess", fail: true},
+		{name: "SHA1", user: "bob", password: "secret", want: "bob"},
+		{name: "SHA1 wrong password", user: "bob", password: "guess", fail: true},
+		{name: "unknown user", user: "carol", password: "secret", fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := request("", "")
+			r.SetBasicAuth(tt.user, tt.password)
+			id, err := a.Authenticate(r)
+			switch {
+			case tt.fail && err == nil:
+				t.Errorf("got user %s, want error", id.Name)
+			case !tt.fail && err != nil:
+				t.Errorf("got error %v, want user %s", err, tt.want)
+			case !tt.fail && id.Name != tt.want:
+				t.Errorf("got user %s, want %s", id.Name, tt.want)
+			}
+		})
+	}
+
+	checkIdentity(t, a, request("Authorization", "Bearer a1b2c3"), "", ErrNoCredentials)
+}
+
+func TestNewBasicAuthInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"without hash", "alice\n"},
+		{"MD5 hash", "alice:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n"},
+		{"plain password", "alice:secret\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewBasicAuth(writeFile(t, tt.content)); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	jwks := `{"keys": [{"kty": "oct", "kid": "test", "alg": "HS256", "k": "` + base64.RawURLEncoding.EncodeToString(key) + `"}]}`
+	a, err := NewJWTAuth(writeFile(t, jwks), "https://issuer.example", "rnnr")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := jwt.RegisteredClaims{
+		Subject:   "alice",
+		Issuer:    "https://issuer.example",
+		Audience:  jwt.ClaimStrings{"rnnr"},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+	sign := func(claims jwt.RegisteredClaims, key []byte) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		token.Header["kid"] = "test"
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name   string
+		claims func(c *jwt.RegisteredClaims)
+		key    []byte
+		want   string
+	}{
+		{name: "valid", want: "alice"},
+		{name: "other key", key: []byte("fedcba9876543210fedcba9876543210")},
+		{name: "expired", claims: func(c *jwt.RegisteredClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }},
+		{name: "other issuer", claims: func(c *jwt.RegisteredClaims) { c.Issuer = "https://other.example" }},
+		{name: "other audience", claims: func(c *jwt.RegisteredClaims) { c.Audience = jwt.ClaimStrings{"other"} }},
+		{name: "without subject", claims: func(c *jwt.RegisteredClaims) { c.Subject = "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid
+			if tt.claims != nil {
+				tt.claims(&claims)
+			}
+			signingKey := key
+			if tt.key != nil {
+				signingKey = tt.key
+			}
+			id, err := a.Authenticate(request("Authorization", "Bearer "+sign(claims, signingKey)))
+			switch {
+			case tt.want == "" && err == nil:
+				t.Errorf("got user %s, want error", id.Name)
+			case tt.want != "" && err != nil:
+				t.Errorf("got error %v, want user %s", err, tt.want)
+			case tt.want != "" && id.Name != tt.want:
+				t.Errorf("got user %s, want %s", id.Name, tt.want)
+			}
+		})
+	}
+
+	checkIdentity(t, a, request("", ""), "", ErrNoCredentials)
+}
+
+// request returns a request with header key, if key is not empty.
+func request(key, value string) *http.Request {
+	r, _ := http.NewRequest(http.MethodGet, "http://localhost:8080/v1/tasks", nil)
+	if key != "" && value != "" {
+		r.Header.Set(key, value)
+	}
+	return r
+}
+
+// checkIdentity checks that authenticator identifies request as user want, or fails with wantErr.
+func checkIdentity(t *testing.T, a Authenticator, r *http.Request, want string, wantErr error) {
+	t.Helper()
+	id, err := a.Authenticate(r)
+	if err != wantErr {
+		t.Fatalf("got error %v, want %v", err, wantErr)
+	}
+	if err == nil && id.Name != want {
+		t.Errorf("got user %s, want %s", id.Name, want)
+	}
+}
+
+// writeFile writes content to a temporary file and returns its name.
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
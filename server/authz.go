@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labbcb/rnnr/models"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Role grants permissions to authenticated users.
+type Role string
+
+const (
+	// Admin can do everything, including purging tasks.
+	Admin Role = "admin"
+	// Operator manages worker nodes and can view and cancel any task.
+	Operator Role = "operator"
+	// Submitter creates tasks and can view and cancel their own tasks.
+	Submitter Role = "submitter"
+	// Viewer can view any task and worker node.
+	Viewer Role = "viewer"
+)
+
+// anyUser grants a role to every authenticated user.
+const anyUser = "*"
+
+// Roles maps user names to their roles.
+type Roles map[string][]Role
+
+// LoadRoles reads roles from a configuration file (YAML, JSON or TOML).
+// Each key is a role with a list of user names. User name * means every authenticated user.
+//
+//	admin: [alice]
+//	operator: [bob]
+//	submitter: ["*"]
+func LoadRoles(file string) (Roles, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	roles := make(Roles)
+	for _, key := range v.AllKeys() {
+		role := Role(key)
+		switch role {
+		case Admin, Operator, Submitter, Viewer:
+		default:
+			return nil, fmt.Errorf("%s: unknown role %s", file, key)
+		}
+		for _, name := range v.GetStringSlice(key) {
+			roles[name] = append(roles[name], role)
+		}
+	}
+	return roles, nil
+}
+
+// Has returns true if user has any of the given roles.
+func (rs Roles) Has(name string, roles ...Role) bool {
+	for _, user := range []string{name, anyUser} {
+		for _, r := range rs[user] {
+			for _, role := range roles {
+				if r == role {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// defaultRoles are granted if authentication is enabled but roles are not defined.
+// Every authenticated user is a submitter, so users only see and cancel their own tasks.
+var defaultRoles = Roles{anyUser: {Submitter}}
+
+// allowed returns true if request caller has any of the given roles.
+// Everything is allowed if authentication is disabled.
+func (m *Main) allowed(r *http.Request, roles ...Role) bool {
+	id := RequestIdentity(r)
+	if id == nil {
+		return true
+	}
+	if m.Roles == nil {
+		return defaultRoles.Has(id.Name, roles...)
+	}
+	return m.Roles.Has(id.Name, roles...)
+}
+
+// authorizeTask returns true if request caller has any of the given roles or is the owner of the task.
+// Otherwise it writes an error response and returns false.
+func (m *Main) authorizeTask(w http.ResponseWriter, r *http.Request, taskID string, roles ...Role) bool {
+	if m.allowed(r, roles...) {
+		return true
+	}
+
+	task, err := m.GetTask(taskID, models.Basic)
+	switch err {
+	case nil:
+	case mongo.ErrNoDocuments:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return false
+	default:
+		log.WithFields(log.Fields{"id": taskID, "error": err}).Error("Unable to get task.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if task.Owner == "" || task.Owner != RequestIdentity(r).Name {
+		forbidden(w, r)
+		return false
+	}
+	return true
+}
+
+// requireRole is a middleware that rejects requests whose caller does not have any of the given roles.
+func (m *Main) requireRole(h http.HandlerFunc, roles ...Role) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !m.allowed(r, roles...) {
+			forbidden(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	var name string
+	if id := RequestIdentity(r); id != nil {
+		name = id.Name
+	}
+	log.WithFields(log.Fields{"user": name, "method": r.Method, "path": r.URL.Path}).Warn("Access denied.")
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	roles := Roles{"alice": {Admin}, "bob": {Operator}, anyUser: {Viewer}}
+	tests := []struct {
+		name  string
+		roles Roles
+		user  string
+		role  Role
+		want  bool
+	}{
+		{name: "authentication disabled", role: Admin, want: true},
+		{name: "without roles users are submitters", user: "carol", role: Submitter, want: true},
+		{name: "without roles users are not admins", user: "carol", role: Admin},
+		{name: "without roles users are not operators", user: "carol", role: Operator},
+		{name: "without roles users are not viewers", user: "carol", role: Viewer},
+		{name: "admin", roles: roles, user: "alice", role: Admin, want: true},
+		{name: "operator is not admin", roles: roles, user: "bob", role: Admin},
+		{name: "any user", roles: roles, user: "carol", role: Viewer, want: true},
+		{name: "submitter not granted", roles: roles, user: "carol", role: Submitter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := request("", "")
+			if tt.user != "" {
+				r = r.WithContext(context.WithValue(r.Context(), identityKey{}, &Identity{Name: tt.user}))
+			}
+			m := &Main{Roles: tt.roles}
+			if got := m.allowed(r, tt.role); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
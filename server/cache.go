@@ -0,0 +1,265 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/labbcb/rnnr/models"
+	"github.com/labbcb/rnnr/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// imageRefresh is how long images listed from a node are trusted when selecting nodes for tasks.
+	imageRefresh = 5 * time.Minute
+	// imageRefreshCheck is how often nodes whose images are not known or are outdated are listed.
+	imageRefreshCheck = time.Minute
+)
+
+// nodeImages keeps image references cached on each node, so that nodes that already have task images are preferred.
+type nodeImages struct {
+	mu    sync.Mutex
+	nodes map[string]*cachedImages
+}
+
+type cachedImages struct {
+	refs   map[string]bool
+	listed time.Time
+}
+
+// set replaces the images of a node.
+func (ni *nodeImages) set(host string, images []*proto.Image) {
+	c := &cachedImages{refs: make(map[string]bool), listed: time.Now()}
+	for _, image := range images {
+		for _, ref := range image.References {
+			c.refs[imageRef(ref)] = true
+		}
+	}
+
+	ni.mu.Lock()
+	defer ni.mu.Unlock()
+	if ni.nodes == nil {
+		ni.nodes = make(map[string]*cachedImages)
+	}
+	ni.nodes[host] = c
+}
+
+// has tells whether node has image. Nodes whose images are not listed are considered without images.
+func (ni *nodeImages) has(host, image string) bool {
+	ni.mu.Lock()
+	defer ni.mu.Unlock()
+	c, ok := ni.nodes[host]
+	return ok && c.refs[imageRef(image)]
+}
+
+// outdated tells whether images of a node are not known or are older than imageRefresh.
+func (ni *nodeImages) outdated(host string) bool {
+	ni.mu.Lock()
+	defer ni.mu.Unlock()
+	c, ok := ni.nodes[host]
+	return !ok || time.Since(c.listed) > imageRefresh
+}
+
+// add records that a node has pulled an image.
+func (ni *nodeImages) add(host, image string) {
+	ni.mu.Lock()
+	defer ni.mu.Unlock()
+	if c, ok := ni.nodes[host]; ok {
+		c.refs[imageRef(image)] = true
+	}
+}
+
+// invalidate makes images of a node be listed again.
+func (ni *nodeImages) invalidate(host string) {
+	ni.mu.Lock()
+	defer ni.mu.Unlock()
+	delete(ni.nodes, host)
+}
+
+// StartImageRefresher keeps images of active nodes listed in background,
+// so that selecting nodes for tasks never waits for nodes.
+func (m *Main) StartImageRefresher() {
+	for {
+		m.refreshImages()
+		time.Sleep(imageRefreshCheck)
+	}
+}
+
+// refreshImages concurrently lists images of active nodes whose images are not known or are outdated.
+// Nodes whose images cannot be listed are considered without images until next refresh.
+func (m *Main) refreshImages() {
+	active := true
+	nodes, err := m.DB.ListNodes(&active)
+	if err != nil {
+		log.WithError(err).Warn("Unable to list nodes.")
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		if !m.images.outdated(node.Host) {
+			continue
+		}
+		wg.Add(1)
+		go func(node *models.Node) {
+			defer wg.Done()
+			images, err := m.Workers.RemoteImages(node.Address())
+			if err != nil && status.Code(err) != codes.Unimplemented {
+				log.WithError(err).WithField("host", node.Host).Warn("Unable to list node images.")
+			}
+			m.images.set(node.Host, images)
+		}(node)
+	}
+	wg.Wait()
+}
+
+// selectNodes returns nodes by host, or all active nodes if hosts is empty.
+func (m *Main) selectNodes(hosts []string) ([]*models.Node, error) {
+	if len(hosts) == 0 {
+		active := true
+		return m.DB.ListNodes(&active)
+	}
+	nodes := make([]*models.Node, len(hosts))
+	for i, host := range hosts {
+		node, err := m.DB.GetNode(host)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %w", host, err)
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
+
+// ListImages lists images cached on nodes, on all active nodes if hosts is empty.
+// Nodes are requested concurrently and failures are reported by node.
+func (m *Main) ListImages(hosts []string) ([]*models.NodeImages, error) {
+	nodes, err := m.selectNodes(hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*models.NodeImages, len(nodes))
+	var wg sync.WaitGroup
+	wg.Add(len(nodes))
+	for i, node := range nodes {
+		go func(i int, node *models.Node) {
+			defer wg.Done()
+			res[i] = &models.NodeImages{Host: node.Host, Images: []*models.Image{}}
+			images, err := m.Workers.RemoteImages(node.Address())
+			if err != nil {
+				res[i].Error = status.Convert(err).Message()
+				return
+			}
+			m.images.set(node.Host, images)
+			for _, image := range images {
+				res[i].Images = append(res[i].Images, asImage(image))
+			}
+		}(i, node)
+	}
+	wg.Wait()
+	return res, nil
+}
+
+// PullImages pulls images on nodes, on all active nodes if none is requested.
+// Nodes pull concurrently, one image at a time.
+func (m *Main) PullImages(req *models.PullImagesRequest) ([]*models.PullImageResult, error) {
+	nodes, err := m.selectNodes(req.Nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([][]*models.PullImageResult, len(nodes))
+	var wg sync.WaitGroup
+	wg.Add(len(nodes))
+	for i, node := range nodes {
+		go func(i int, node *models.Node) {
+			defer wg.Done()
+			for _, image := range req.Images {
+				results[i] = append(results[i], m.pullNodeImage(node, image, req.PullPolicy))
+			}
+		}(i, node)
+	}
+	wg.Wait()
+
+	res := []*models.PullImageResult{}
+	for _, r := range results {
+		res = append(res, r...)
+	}
+	return res, nil
+}
+
+func (m *Main) pullNodeImage(node *models.Node, image, policy string) *models.PullImageResult {
+	res := &models.PullImageResult{Host: node.Host, Image: image}
+	fields := log.Fields{"host": node.Host, "image": image}
+	var last *proto.PullProgress
+	pulled, err := m.Workers.RemotePullImage(node.Address(), image, policy, func(p *proto.PullProgress) {
+		if p.Digest != "" {
+			res.Digest = p.Digest
+			return
+		}
+		last = p
+	})
+	switch {
+	case err != nil:
+		res.Error = status.Convert(err).Message()
+		log.WithError(err).WithFields(fields).Warn("Unable to pull image.")
+	case !pulled:
+		res.Error = "node does not support pulling images"
+	default:
+		if last != nil {
+			res.Size = last.Total
+		}
+		m.images.add(node.Host, image)
+		log.WithFields(fields).Info("Image pulled.")
+	}
+	return res
+}
+
+// PruneImages removes images that no task uses from nodes, on all active nodes if none is requested.
+func (m *Main) PruneImages(req *models.PruneImagesRequest) ([]*models.PruneImagesResult, error) {
+	nodes, err := m.selectNodes(req.Nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*models.PruneImagesResult, len(nodes))
+	var wg sync.WaitGroup
+	wg.Add(len(nodes))
+	for i, node := range nodes {
+		go func(i int, node *models.Node) {
+			defer wg.Done()
+			defer m.images.invalidate(node.Host)
+			res[i] = &models.PruneImagesResult{Host: node.Host, Removed: []*models.Image{}}
+			pruned, err := m.Workers.RemotePrune(node.Address(), &proto.PruneRequest{MaxSize: req.MaxSize, UnusedSeconds: req.UnusedSeconds})
+			if err != nil {
+				res[i].Error = status.Convert(err).Message()
+				log.WithError(err).WithField("host", node.Host).Warn("Unable to prune images.")
+				return
+			}
+			for _, image := range pruned.Removed {
+				res[i].Removed = append(res[i].Removed, asImage(image))
+			}
+			res[i].Reclaimed = pruned.Reclaimed
+			log.WithFields(log.Fields{"host": node.Host, "images": len(pruned.Removed), "reclaimed": pruned.Reclaimed}).Info("Images pruned.")
+		}(i, node)
+	}
+	wg.Wait()
+	return res, nil
+}
+
+func asImage(image *proto.Image) *models.Image {
+	i := &models.Image{
+		ID:         image.Id,
+		References: image.References,
+		Size:       image.Size,
+		InUse:      image.InUse,
+	}
+	if image.LastUsed != nil {
+		t := image.LastUsed.AsTime()
+		i.LastUsed = &t
+	}
+	return i
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"regexp"
 	"time"
 
 	"github.com/labbcb/rnnr/models"
@@ -25,11 +27,20 @@ type DB struct {
 }
 
 // MongoConnect creates a MongoDB client.
+// It creates the index used to list tasks by creation time.
 func MongoConnect(uri, database string) (*DB, error) {
 	c, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
 	if err != nil {
 		return nil, err
 	}
+
+	_, err = c.Database(database).Collection(TaskCollection).Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "created", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating tasks index: %w", err)
+	}
+
 	return &DB{client: c, database: database}, nil
 }
 
@@ -44,24 +55,7 @@ func (d *DB) SaveTask(t *models.Task) error {
 
 // GetTask finds a task by its ID.
 func (d *DB) GetTask(id string, view models.View) (*models.Task, error) {
-	opts := options.FindOne()
-
-	var projection bson.M
-	switch view {
-	case models.Minimal:
-		projection = bson.M{
-			"_id":   1,
-			"state": 1,
-		}
-	case models.Basic:
-		projection = bson.M{
-			"Logs.ExecutorLog.Stdout": 0,
-			"Logs.ExecutorLog.Stderr": 0,
-			"Input.Content":           0,
-			"Logs.SystemLogs":         0,
-		}
-	}
-	opts.SetProjection(projection)
+	opts := options.FindOne().SetProjection(taskProjection(view))
 
 	var t models.Task
 	if err := d.client.Database(d.database).Collection(TaskCollection).FindOne(context.Background(), bson.M{"_id": id}, opts).Decode(&t); err != nil {
@@ -77,51 +71,153 @@ func (d *DB) UpdateTask(t *models.Task) error {
 		FindOneAndReplace(context.Background(), bson.M{"_id": t.ID}, &t, options.FindOneAndReplace()).Err()
 }
 
-// ListTasks retrieves tasks that match given worker nodes and states.
-// Pagination is done via limit and skip parameters.
+// UpdateSystemLogs replaces system logs of a task if it is in state.
+func (d *DB) UpdateSystemLogs(id string, state models.State, logs []string) error {
+	_, err := d.client.Database(d.database).Collection(TaskCollection).
+		UpdateOne(context.Background(), bson.M{"_id": id, "state": state}, bson.M{"$set": bson.M{"logs.0.systemlogs": logs}})
+	return err
+}
+
+// UpdateRunningMetrics sets CPU usage and raises maximum memory of a task if it is still running on host.
+func (d *DB) UpdateRunningMetrics(id, host string, cpuTime uint64, cpuPercent float64, memory uint64) error {
+	_, err := d.client.Database(d.database).Collection(TaskCollection).
+		UpdateOne(context.Background(), bson.M{"_id": id, "state": models.Running, "host": host}, bson.M{
+			"$set": bson.M{"metrics.cputime": cpuTime, "metrics.cpupercentage": cpuPercent},
+			"$max": bson.M{"metrics.memory": memory},
+		})
+	return err
+}
+
+// AddRunningSystemLog appends a system log to a task if it is still running on host.
+func (d *DB) AddRunningSystemLog(id, host, log string) error {
+	_, err := d.client.Database(d.database).Collection(TaskCollection).
+		UpdateOne(context.Background(), bson.M{"_id": id, "state": models.Running, "host": host}, bson.M{"$push": bson.M{"logs.0.systemlogs": log}})
+	return err
+}
+
+// ListTasks retrieves tasks that match given filter.
+// Tasks are sorted by creation time and ID.
+// Pagination is done via limit and after parameters, where after points to the last task of previous page.
 // view defines task fields to be returned.
 //
-// Minimal returns only task ID and state.
+// Minimal returns only task ID, state and creation time (required to create page tokens).
 //
 // Basic returns all fields except Logs.ExecutorLogs.Stdout, Logs.ExecutorLogs.Stderr, Inputs.Content and Logs.SystemLogs.
 //
 // Full returns all fields.
-func (d *DB) ListTasks(limit, skip int64, view models.View, nodes []string, states []models.State) ([]*models.Task, error) {
-	opts := options.Find()
+func (d *DB) ListTasks(limit int64, after *PageToken, view models.View, filter *models.TaskFilter) ([]*models.Task, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: 1}, {Key: "_id", Value: 1}})
 	if limit > 0 {
 		opts.SetLimit(limit)
 	}
-	opts.SetSkip(skip)
 
 	var filters bson.A
-	if len(nodes) != 0 {
-		filters = append(filters, bson.M{"worker.host": bson.M{"$in": nodes}})
+	if after != nil {
+		filters = append(filters, bson.M{"$or": bson.A{
+			bson.M{"created": bson.M{"$gt": after.Created}},
+			bson.M{"created": after.Created, "_id": bson.M{"$gt": after.ID}},
+		}})
 	}
-	if len(states) != 0 {
-		filters = append(filters, bson.M{"state": bson.M{"$in": states}})
+	if filter != nil {
+		filters = append(filters, taskFilters(filter)...)
 	}
 
-	filter := bson.M{}
+	query := bson.M{}
 	if len(filters) > 0 {
-		filter = bson.M{"$and": filters}
+		query = bson.M{"$and": filters}
+	}
+
+	projection := taskProjection(view)
+	if view == models.Minimal {
+		projection["created"] = 1
 	}
+	opts.SetProjection(projection)
 
-	var projection bson.M
+	cursor, err := d.client.Database(d.database).Collection(TaskCollection).Find(context.Background(), query, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := cursor.Close(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	var tasks []*models.Task
+	if err := cursor.All(context.Background(), &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// taskProjection returns the fields of a task to be retrieved in given view.
+//
+// Minimal includes only task ID and state.
+//
+// Basic excludes executor stdout and stderr, input contents and system logs.
+//
+// Full (or any other view) includes all fields.
+func taskProjection(view models.View) bson.M {
 	switch view {
 	case models.Minimal:
-		projection = bson.M{
+		return bson.M{
 			"_id":   1,
 			"state": 1,
 		}
 	case models.Basic:
-		projection = bson.M{
-			"Logs.ExecutorLog.Stdout": 0,
-			"Logs.ExecutorLog.Stderr": 0,
-			"Input.Content":           0,
-			"Logs.SystemLogs":         0,
+		return bson.M{
+			"logs.executorlogs.stdout": 0,
+			"logs.executorlogs.stderr": 0,
+			"inputs.content":           0,
+			"logs.systemlogs":          0,
 		}
+	default:
+		return nil
+	}
+}
+
+// taskFilters converts task filter to MongoDB query conditions.
+func taskFilters(f *models.TaskFilter) bson.A {
+	var filters bson.A
+	if f.NamePrefix != "" {
+		filters = append(filters, bson.M{"name": bson.M{"$regex": "^" + regexp.QuoteMeta(f.NamePrefix)}})
+	}
+	if f.Owner != "" {
+		filters = append(filters, bson.M{"owner": f.Owner})
+	}
+	if len(f.Nodes) != 0 {
+		filters = append(filters, bson.M{"host": bson.M{"$in": f.Nodes}})
+	}
+	if len(f.States) != 0 {
+		filters = append(filters, bson.M{"state": bson.M{"$in": f.States}})
+	}
+	for key, value := range f.Tags {
+		field := "tags." + key
+		if value == "" {
+			filters = append(filters, bson.M{field: bson.M{"$exists": true}})
+		} else {
+			filters = append(filters, bson.M{field: value})
+		}
+	}
+	return filters
+}
+
+// ListTasksBefore retrieves up to limit tasks in given states that ended before given time.
+// Tasks without end time are selected by their creation time.
+// Tasks are sorted by creation time, oldest first.
+func (d *DB) ListTasksBefore(before time.Time, states []models.State, limit int64) ([]*models.Task, error) {
+	filter := bson.M{
+		"state": bson.M{"$in": states},
+		"$or": bson.A{
+			bson.M{"logs.endtime": bson.M{"$lt": before}},
+			bson.M{"logs.endtime": nil, "created": bson.M{"$lt": before}},
+		},
+	}
+
+	opts := options.Find().SetSort(bson.M{"created": 1})
+	if limit > 0 {
+		opts.SetLimit(limit)
 	}
-	opts.SetProjection(projection)
 
 	cursor, err := d.client.Database(d.database).Collection(TaskCollection).Find(context.Background(), filter, opts)
 	if err != nil {
@@ -140,6 +236,16 @@ func (d *DB) ListTasks(limit, skip int64, view models.View, nodes []string, stat
 	return tasks, nil
 }
 
+// DeleteTasks removes tasks by their IDs returning the number of deleted tasks.
+func (d *DB) DeleteTasks(ids []string) (int64, error) {
+	res, err := d.client.Database(d.database).Collection(TaskCollection).
+		DeleteMany(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
 // ListNodes returns worker nodes (disabled included).
 // Set active to return active (enabled) or disable nodes.
 func (d *DB) ListNodes(active *bool) ([]*models.Node, error) {
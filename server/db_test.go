@@ -0,0 +1,274 @@
+package server
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labbcb/rnnr/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TES fields excluded from BASIC view, as JSON paths.
+var basicExcluded = []string{
+	"inputs.content",
+	"logs.logs.stderr",
+	"logs.logs.stdout",
+	"logs.system_logs",
+}
+
+func TestTaskProjection(t *testing.T) {
+	full := jsonPaths(t, project(t, fullTask(), taskProjection(models.Full)))
+	for _, p := range append([]string{"id", "state"}, basicExcluded...) {
+		if !contains(full, p) {
+			t.Fatalf("FULL view is missing %s", p)
+		}
+	}
+
+	tests := []struct {
+		view models.View
+		want []string
+	}{
+		{models.Minimal, []string{"id", "state"}},
+		{models.Basic, without(full, basicExcluded)},
+		{models.Full, full},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.view), func(t *testing.T) {
+			got := jsonPaths(t, project(t, fullTask(), taskProjection(tt.view)))
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("got fields\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTaskFiltersFields(t *testing.T) {
+	filter := &models.TaskFilter{
+		NamePrefix: "call",
+		Nodes:      []string{"worker1"},
+		States:     []models.State{models.Running},
+		Tags:       map[string]string{"project": "exome"},
+		Owner:      "alice",
+	}
+
+	doc := asDocument(t, fullTask())
+	for _, f := range taskFilters(filter) {
+		for key := range f.(bson.M) {
+			if !hasPath(doc, strings.Split(key, ".")) {
+				t.Errorf("filter field %s does not match any task field", key)
+			}
+		}
+	}
+}
+
+func fullTask() *models.Task {
+	now := time.Now().Truncate(time.Millisecond)
+	return &models.Task{
+		ID:          "task-id",
+		State:       models.Complete,
+		Name:        "call-align",
+		Description: "Align reads",
+		Created:     &now,
+		Resources: &models.Resources{
+			CPUCores:    2,
+			RAMGb:       4,
+			DiskGb:      10,
+			Zones:       []string{"zone"},
+			Preemptible: true,
+		},
+		Executors: []models.Executor{{
+			Image:   "ubuntu",
+			Command: []string{"echo"},
+			WorkDir: "/tmp",
+			Stdin:   "/tmp/stdin",
+			Stdout:  "/tmp/stdout",
+			Stderr:  "/tmp/stderr",
+			Env:     map[string]string{"KEY": "value"},
+		}},
+		Inputs: []*models.Input{{
+			Name:        "input",
+			Description: "Input file",
+			URL:         "/data/in.txt",
+			Path:        "/in/in.txt",
+			Type:        models.File,
+			Content:     "content",
+		}},
+		Outputs: []*models.Output{{
+			Name:        "output",
+			Description: "Output file",
+			URL:         "/data/out.txt",
+			Path:        "/out/out.txt",
+			Type:        models.File,
+		}},
+		Volumes: []string{"/vol"},
+		Tags:    map[string]string{"project": "exome"},
+		Logs: []*models.TaskLog{{
+			ExecutorLogs: []*models.ExecutorLog{{
+				ExitCode:  1,
+				StartTime: now,
+				EndTime:   now,
+				Stdout:    "out",
+				Stderr:    "err",
+			}},
+			Metadata:  map[string]string{"key": "value"},
+			StartTime: &now,
+			EndTime:   &now,
+			Outputs: []*models.OutputFileLog{{
+				URL:       "/data/out.txt",
+				Path:      "/out/out.txt",
+				SizeBytes: "10",
+			}},
+			SystemLogs: []string{"log"},
+		}},
+		Owner:   "alice",
+		Host:    "worker1",
+		Metrics: &models.Metrics{CPUTime: 1, CPUPercentage: 1, Memory: 1},
+	}
+}
+
+// project applies a MongoDB projection to a task the way the database server does.
+func project(t *testing.T, task *models.Task, projection bson.M) *models.Task {
+	doc := asDocument(t, task)
+
+	var include []string
+	for path, v := range projection {
+		if v == 0 {
+			exclude(doc, strings.Split(path, "."))
+		} else {
+			include = append(include, path)
+		}
+	}
+	if len(include) > 0 {
+		kept := bson.M{}
+		for _, path := range include {
+			if strings.Contains(path, ".") {
+				t.Fatalf("nested inclusion %s not supported by test", path)
+			}
+			if v, ok := doc[path]; ok {
+				kept[path] = v
+			}
+		}
+		doc = kept
+	}
+
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var projected models.Task
+	if err := bson.Unmarshal(b, &projected); err != nil {
+		t.Fatal(err)
+	}
+	return &projected
+}
+
+func asDocument(t *testing.T, v interface{}) bson.M {
+	b, err := bson.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// exclude removes path from document, descending into arrays.
+func exclude(v interface{}, path []string) {
+	switch v := v.(type) {
+	case bson.M:
+		if len(path) == 1 {
+			delete(v, path[0])
+			return
+		}
+		exclude(v[path[0]], path[1:])
+	case primitive.A:
+		for _, e := range v {
+			exclude(e, path)
+		}
+	}
+}
+
+// hasPath reports whether path exists in document, descending into arrays.
+func hasPath(v interface{}, path []string) bool {
+	if len(path) == 0 {
+		return true
+	}
+	switch v := v.(type) {
+	case bson.M:
+		e, ok := v[path[0]]
+		return ok && hasPath(e, path[1:])
+	case primitive.A:
+		for _, e := range v {
+			if hasPath(e, path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jsonPaths returns sorted dot-separated paths of all JSON fields with values, descending into arrays.
+func jsonPaths(t *testing.T, task *models.Task) []string {
+	b, err := json.Marshal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+
+	set := map[string]bool{}
+	var walk func(prefix string, v interface{})
+	walk = func(prefix string, v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, e := range v {
+				if prefix == "" {
+					walk(k, e)
+				} else {
+					walk(prefix+"."+k, e)
+				}
+			}
+		case []interface{}:
+			for _, e := range v {
+				walk(prefix, e)
+			}
+		default:
+			set[prefix] = true
+		}
+	}
+	walk("", v)
+
+	var paths []string
+	for p := range set {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func without(paths, excluded []string) []string {
+	var res []string
+	for _, p := range paths {
+		if !contains(excluded, p) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func contains(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -3,12 +3,15 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
-	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/protobuf/ptypes/timestamp"
@@ -18,8 +21,11 @@ import (
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 )
 
 // Docker struct wraps Docker client
@@ -28,32 +34,72 @@ type Docker struct {
 	volumes []string
 	user    string
 	group   string
+	// auths has registry credentials used to pull images.
+	auths *RegistryAuths
+	// security hardens containers, securityOpt has its Docker security options.
+	security    SecurityProfile
+	securityOpt []string
+
+	// samples keeps the last CPU usage of running containers to compute CPU percentage between checks.
+	samples sync.Map
+}
+
+// cpuSample is the CPU usage of a container and of the whole system at some point.
+type cpuSample struct {
+	total, system uint64
 }
 
 // DockerConnect creates a Docker client using environment variables
 func DockerConnect(volumes []string, user, group string) (*Docker, error) {
-	c, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	return dockerConnect(volumes, user, group, client.FromEnv)
+}
+
+func dockerConnect(volumes []string, user, group string, opts ...client.Opt) (*Docker, error) {
+	c, err := client.NewClientWithOpts(append(opts, client.WithAPIVersionNegotiation())...)
 	if err != nil {
 		return nil, err
 	}
-	return &Docker{c, volumes, user, group}, nil
+	return &Docker{client: c, volumes: volumes, user: user, group: group}, nil
+}
+
+// configure sets registry credentials and security profile.
+func (d *Docker) configure(opts RuntimeOptions) error {
+	d.auths = opts.Registries
+	d.security = opts.Security
+	var err error
+	d.securityOpt, err = opts.Security.dockerSecurityOpt()
+	return err
 }
 
 // Run runs a container
 func (d *Docker) Run(ctx context.Context, container *proto.Container) error {
-	if err := d.pullImage(container.Image, ioutil.Discard); err != nil {
-		log.WithError(err).WithField("image", container.Image).Warn("Unable to pull image.")
+	volumes, err := mounts(d.volumes, container)
+	if err != nil {
+		return err
+	}
+	if _, err := d.Pull(ctx, container.Image, PullPolicy(container.PullPolicy), nil); err != nil {
+		return fmt.Errorf("unable to pull image %s: %w", container.Image, err)
 	}
 
 	var env []string
 	for k, v := range container.Env {
 		env = append(env, fmt.Sprintf("%s=%s", k, v))
 	}
+	env = append(env, scratchEnv(container, ScratchPath)...)
 
-	volumes := d.mounts(container)
+	labels := map[string]string{}
+	for k, v := range container.Labels {
+		labels[k] = v
+	}
+	labels[taskLabel] = container.Id
+
+	user := fmt.Sprintf("%s:%s", d.user, d.group)
+	if container.User != "" {
+		user = container.User
+	}
 
 	return d.runContainer(ctx, container.Id, container.Image, container.Command, container.WorkDir,
-		env, volumes)
+		env, volumes, labels, user, container.Security)
 }
 
 // Stop stops a container
@@ -69,7 +115,7 @@ func (d *Docker) Stop(ctx context.Context, id string) error {
 func (d *Docker) Check(ctx context.Context, container *proto.Container) (*proto.State, error) {
 	resp, err := d.client.ContainerInspect(ctx, container.Id)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err)
 	}
 
 	state := proto.State{}
@@ -85,8 +131,307 @@ func (d *Docker) Check(ctx context.Context, container *proto.Container) (*proto.
 	return &state, nil
 }
 
+// CheckAll returns the states of containers in one request to Docker.
+// If ids is empty it returns the states of all containers managed by RNNR.
+// Containers that do not exist are not included.
+// Usage of running containers is sampled without waiting, CPU percentage is relative to the previous check.
+func (d *Docker) CheckAll(ctx context.Context, ids []string) (map[string]*proto.State, error) {
+	args := filters.NewArgs()
+	if len(ids) == 0 {
+		args.Add("label", taskLabel)
+	}
+	for _, id := range ids {
+		args.Add("name", "^/"+regexp.QuoteMeta(id)+"$")
+	}
+	containers, err := d.client.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	return d.states(ctx, containers), nil
+}
+
+// states checks listed containers concurrently.
+func (d *Docker) states(ctx context.Context, containers []types.Container) map[string]*proto.State {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	states := make(map[string]*proto.State)
+	for _, c := range containers {
+		if len(c.Names) == 0 {
+			continue
+		}
+		id := strings.TrimPrefix(c.Names[0], "/")
+
+		wg.Add(1)
+		go func(id string, running bool) {
+			defer wg.Done()
+			var state *proto.State
+			if running {
+				state = &proto.State{}
+				state.CpuPercent, state.CpuTime, state.Memory = d.sampleUsage(ctx, id)
+			} else {
+				var err error
+				if state, err = d.Check(ctx, &proto.Container{Id: id}); err != nil {
+					log.WithError(err).WithField("id", id).Warn("Unable to check container.")
+					return
+				}
+			}
+			mu.Lock()
+			states[id] = state
+			mu.Unlock()
+		}(id, c.State == "running")
+	}
+	wg.Wait()
+	return states
+}
+
+// Watch sends events of containers managed by RNNR until ctx is canceled or Docker connection fails.
+// Usage of running containers is sampled every interval.
+// subscribed is called once Docker events are being received.
+func (d *Docker) Watch(ctx context.Context, interval time.Duration, subscribed func() error, send func(*proto.Event) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	msgs, errs := d.client.Events(ctx, types.EventsOptions{Filters: filters.NewArgs(
+		filters.Arg("type", events.ContainerEventType),
+		filters.Arg("label", taskLabel),
+		filters.Arg("event", "start"),
+		filters.Arg("event", "die"),
+		filters.Arg("event", "oom"),
+	)})
+	if err := subscribed(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		case msg := <-msgs:
+			if err := send(asEvent(msg)); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			states, err := d.CheckAll(ctx, nil)
+			if err != nil {
+				log.WithError(err).Warn("Unable to sample container usage.")
+				continue
+			}
+			now := timestamppb.Now()
+			for id, state := range states {
+				if state.Exited {
+					continue
+				}
+				if err := send(&proto.Event{Type: proto.Event_USAGE, Id: id, Time: now, State: state}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// asEvent converts a Docker container event.
+func asEvent(msg events.Message) *proto.Event {
+	e := &proto.Event{
+		Id:   msg.Actor.Attributes[taskLabel],
+		Time: timestamppb.New(time.Unix(0, msg.TimeNano)),
+	}
+	switch msg.Action {
+	case "start":
+		e.Type = proto.Event_START
+	case "die":
+		e.Type = proto.Event_EXIT
+		code, ok := msg.Actor.Attributes["exitCode"]
+		if !ok {
+			// Podman names it differently.
+			code = msg.Actor.Attributes["containerExitCode"]
+		}
+		exitCode, _ := strconv.Atoi(code)
+		e.State = &proto.State{Exited: true, ExitCode: int32(exitCode)}
+	case "oom":
+		e.Type = proto.Event_OOM
+	}
+	return e
+}
+
+// Managed returns containers managed by RNNR, running or not, by task ID.
+func (d *Docker) Managed(ctx context.Context) (map[string]*ContainerSummary, error) {
+	containers, err := d.listManaged(ctx)
+	if err != nil {
+		return nil, err
+	}
+	managed := make(map[string]*ContainerSummary)
+	for _, c := range containers {
+		managed[c.Labels[taskLabel]] = &ContainerSummary{
+			Running: c.State == "running",
+			Created: time.Unix(c.Created, 0),
+		}
+	}
+	return managed, nil
+}
+
+func (d *Docker) listManaged(ctx context.Context) ([]types.Container, error) {
+	return d.client.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", taskLabel)),
+	})
+}
+
+// sampleUsage returns container usage without waiting for a second sample like getUsage does.
+func (d *Docker) sampleUsage(ctx context.Context, id string) (cpuPercent float64, cpuTime, memory uint64) {
+	resp, err := d.client.ContainerStatsOneShot(ctx, id)
+	if err != nil {
+		log.WithError(err).WithField("id", id).Warn("Unable to get container stats.")
+		return
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.WithError(err).Warn("Unable to close container stats.")
+		}
+	}()
+
+	var stats types.Stats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		log.WithError(err).Warn("Unable to decode container stats.")
+		return
+	}
+
+	sample := cpuSample{stats.CPUStats.CPUUsage.TotalUsage, stats.CPUStats.SystemUsage}
+	if v, ok := d.samples.Load(id); ok {
+		prev := v.(cpuSample)
+		if sample.system > prev.system && sample.total >= prev.total {
+			cpus := stats.CPUStats.OnlineCPUs
+			if cpus == 0 {
+				cpus = uint32(len(stats.CPUStats.CPUUsage.PercpuUsage))
+			}
+			cpuPercent = float64(sample.total-prev.total) / float64(sample.system-prev.system) * float64(cpus) * 100.0
+		}
+	}
+	d.samples.Store(id, sample)
+
+	return cpuPercent, sample.total, stats.MemoryStats.Stats["rss"]
+}
+
+// Logs copies container standard output and error to stdout and stderr writers.
+// A nil writer skips that output.
+// If follow is true it keeps copying until container exits or ctx is canceled.
+// tail is the number of lines from the end of logs, all lines if zero or negative.
+func (d *Docker) Logs(ctx context.Context, id string, follow bool, tail int32, stdout, stderr io.Writer) error {
+	options := types.ContainerLogsOptions{
+		ShowStdout: stdout != nil,
+		ShowStderr: stderr != nil,
+		Follow:     follow,
+		Tail:       "all",
+	}
+	if tail > 0 {
+		options.Tail = strconv.Itoa(int(tail))
+	}
+	reader, err := d.client.ContainerLogs(ctx, id, options)
+	if err != nil {
+		return notFound(err)
+	}
+	defer func() {
+		if err := reader.Close(); err != nil {
+			log.WithError(err).Warn("Unable to close container logs.")
+		}
+	}()
+
+	// Containers run without TTY, so standard output and error are multiplexed.
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	_, err = stdcopy.StdCopy(stdout, stderr, reader)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// dockerExec is a command executed with a TTY in a running container.
+type dockerExec struct {
+	client *client.Client
+	id     string
+	resp   types.HijackedResponse
+}
+
+// Exec executes command in a running container with a TTY.
+// Terminal is resized if width and height are not zero.
+func (d *Docker) Exec(ctx context.Context, id string, command []string, width, height uint) (ExecSession, error) {
+	exec, err := d.client.ContainerExecCreate(ctx, id, types.ExecConfig{
+		Cmd:          command,
+		Tty:          true,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	resp, err := d.client.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{Tty: true})
+	if err != nil {
+		return nil, err
+	}
+	s := &dockerExec{client: d.client, id: exec.ID, resp: resp}
+	if err := s.Resize(ctx, width, height); err != nil {
+		log.WithError(err).WithField("id", id).Warn("Unable to resize terminal.")
+	}
+	return s, nil
+}
+
+// Read reads terminal output.
+func (s *dockerExec) Read(p []byte) (int, error) {
+	return s.resp.Reader.Read(p)
+}
+
+// Write writes to terminal input.
+func (s *dockerExec) Write(p []byte) (int, error) {
+	return s.resp.Conn.Write(p)
+}
+
+// Resize resizes terminal if width and height are not zero.
+func (s *dockerExec) Resize(ctx context.Context, width, height uint) error {
+	if width == 0 || height == 0 {
+		return nil
+	}
+	return s.client.ContainerExecResize(ctx, s.id, types.ResizeOptions{Width: width, Height: height})
+}
+
+// CloseInput closes terminal input.
+func (s *dockerExec) CloseInput() error {
+	return s.resp.CloseWrite()
+}
+
+// Close closes the connection with command.
+// The command keeps running if it has not exited.
+func (s *dockerExec) Close() {
+	s.resp.Close()
+}
+
+// ExitCode returns the exit code of the command, or -1 if it is still running.
+func (s *dockerExec) ExitCode(ctx context.Context) (int, error) {
+	resp, err := s.client.ContainerExecInspect(ctx, s.id)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Running {
+		return -1, nil
+	}
+	return resp.ExitCode, nil
+}
+
 // RemoveContainer removes a container.
 func (d *Docker) RemoveContainer(ctx context.Context, id string) {
+	d.samples.Delete(id)
 	if err := d.client.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true}); err != nil {
 		log.WithError(err).Warn("Unable to remove container.")
 	} else {
@@ -94,38 +439,183 @@ func (d *Docker) RemoveContainer(ctx context.Context, id string) {
 	}
 }
 
+// notFound returns ContainerNotFound if Docker did not find the container.
+func notFound(err error) error {
+	if client.IsErrNotFound(err) {
+		return &ContainerNotFound{err}
+	}
+	return err
+}
+
 func asTimestamp(s string) *timestamp.Timestamp {
 	t, _ := time.Parse(time.RFC3339Nano, s)
 	return timestamppb.New(t)
 }
 
-func (d *Docker) pullImage(image string, w io.Writer) error {
-	reader, err := d.client.ImagePull(context.Background(), image, types.ImagePullOptions{})
+// Pull pulls image according to policy using registry credentials.
+// Progress is reported at most every pullProgressInterval if progress is not nil.
+func (d *Docker) Pull(ctx context.Context, image string, policy PullPolicy, progress func(*proto.PullProgress)) (string, error) {
+	if policy != PullAlways {
+		inspect, _, err := d.client.ImageInspectWithRaw(ctx, image)
+		if err == nil {
+			return repoDigest(image, inspect.RepoDigests), nil
+		}
+		if !client.IsErrNotFound(err) {
+			return "", err
+		}
+		if policy == PullNever {
+			return "", fmt.Errorf("image %s is not present and pull policy is %s", image, policy)
+		}
+	}
+
+	auth, err := d.auths.encoded(image)
 	if err != nil {
-		return err
+		return "", err
+	}
+	reader, err := d.client.ImagePull(ctx, image, types.ImagePullOptions{RegistryAuth: auth})
+	if err != nil {
+		return "", err
 	}
 	defer func() {
 		if err := reader.Close(); err != nil {
-			log.Fatal(err)
+			log.WithError(err).Warn("Unable to close image pull.")
 		}
 	}()
-	_, err = io.Copy(w, reader)
+	if err := readPull(reader, progress); err != nil {
+		return "", err
+	}
+
+	inspect, _, err := d.client.ImageInspectWithRaw(ctx, image)
 	if err != nil {
-		return err
+		return "", err
+	}
+	return repoDigest(image, inspect.RepoDigests), nil
+}
+
+// pullProgressInterval limits how often pull progress is reported.
+const pullProgressInterval = time.Second
+
+// pullMessage is a message of Docker image pull stream.
+type pullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error string `json:"error"`
+}
+
+// readPull reads Docker image pull stream until pull completes.
+// Docker reports pull failures in the stream.
+func readPull(r io.Reader, progress func(*proto.PullProgress)) error {
+	type layer struct{ current, total int64 }
+	layers := make(map[string]*layer)
+	var status string
+	var reported time.Time
+	report := func() {
+		p := &proto.PullProgress{Status: status}
+		for _, l := range layers {
+			p.Current += l.current
+			p.Total += l.total
+		}
+		progress(p)
+		reported = time.Now()
+	}
+
+	decoder := json.NewDecoder(r)
+	for {
+		var msg pullMessage
+		if err := decoder.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+
+		status = msg.Status
+		if msg.ID != "" {
+			if msg.ProgressDetail.Total > 0 && msg.Status == "Downloading" {
+				layers[msg.ID] = &layer{msg.ProgressDetail.Current, msg.ProgressDetail.Total}
+			} else if l, ok := layers[msg.ID]; ok && msg.Status == "Download complete" {
+				l.current = l.total
+			}
+		}
+		if progress != nil && time.Since(reported) >= pullProgressInterval {
+			report()
+		}
+	}
+
+	if progress != nil {
+		report()
 	}
 	return nil
 }
 
-func (d *Docker) runContainer(ctx context.Context, id, image string, command []string, workDir string, env []string, mounts []mount.Mount) error {
+// Images lists images on the node. Images of any container, stopped ones included, are in use.
+func (d *Docker) Images(ctx context.Context) ([]*proto.Image, error) {
+	summaries, err := d.client.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	containers, err := d.client.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, c := range containers {
+		used[c.ImageID] = true
+	}
+
+	images := make([]*proto.Image, 0, len(summaries))
+	for _, s := range summaries {
+		image := &proto.Image{Id: s.ID, Size: s.Size, InUse: used[s.ID]}
+		for _, ref := range append(s.RepoTags, s.RepoDigests...) {
+			if !strings.HasPrefix(ref, "<none>") {
+				image.References = append(image.References, ref)
+			}
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// RemoveImage removes an image and all its tags. Images of running containers are not removed.
+func (d *Docker) RemoveImage(ctx context.Context, id string) error {
+	_, err := d.client.ImageRemove(ctx, id, types.ImageRemoveOptions{Force: true, PruneChildren: true})
+	return err
+}
+
+func (d *Docker) runContainer(ctx context.Context, id, image string, command []string, workDir string, env []string, mounts []mount.Mount, labels map[string]string, user string, security *proto.Security) error {
+	if security == nil {
+		security = &proto.Security{}
+	}
+	host := &container.HostConfig{
+		Mounts:      mounts,
+		SecurityOpt: d.securityOpt,
+		CapAdd:      security.Capabilities,
+	}
+	if d.security.DropCapabilities {
+		host.CapDrop = []string{"ALL"}
+	}
+	if d.security.ReadOnlyRootfs && !security.WritableRootfs {
+		host.ReadonlyRootfs = true
+		host.Tmpfs = map[string]string{"/tmp": "rw,exec,nosuid,nodev"}
+	}
+	if d.security.NetworkNone && !security.Network {
+		host.NetworkMode = "none"
+	}
+
 	resp, err := d.client.ContainerCreate(ctx, &container.Config{
 		Image:      image,
 		Cmd:        command,
 		WorkingDir: workDir,
 		Env:        env,
-		User:       fmt.Sprintf("%s:%s", d.user, d.group),
-	}, &container.HostConfig{
-		Mounts: mounts,
-	}, nil, nil, id)
+		User:       user,
+		Labels:     labels,
+	}, host, nil, nil, id)
 	if err != nil {
 		return err
 	}
@@ -160,63 +650,3 @@ func (d *Docker) getUsage(ctx context.Context, id string) (cpuPercent float64, c
 
 	return cpuPercent, stats.CPUStats.CPUUsage.TotalUsage, stats.MemoryStats.Stats["rss"]
 }
-
-func (d *Docker) mounts(t *proto.Container) []mount.Mount {
-	var volumes []mount.Mount
-
-	for _, v := range d.volumes {
-		volumes = append(volumes, mount.Mount{
-			Type:     mount.TypeBind,
-			Source:   v,
-			Target:   v,
-			ReadOnly: false,
-		})
-	}
-
-	for _, output := range t.Outputs {
-		volumes = addVolume(volumes, output.HostPath, output.ContainerPath, false)
-	}
-
-	for _, input := range t.Inputs {
-		volumes = addVolume(volumes, input.HostPath, input.ContainerPath, true)
-	}
-
-	return volumes
-}
-
-func addVolume(volumes []mount.Mount, hostPath, containerPath string, readOnly bool) []mount.Mount {
-
-	hostDir := filepath.Dir(hostPath)
-	containerDir := filepath.Dir(containerPath)
-
-	for i := range volumes {
-		// if container path is subpath of already added volume
-		if strings.HasPrefix(containerPath, volumes[i].Target) {
-
-			// if is read-only and host path is different of added volume
-			if readOnly && hostDir != volumes[i].Source {
-				return append(volumes, mount.Mount{
-					Type:     mount.TypeBind,
-					Source:   hostPath,
-					Target:   containerPath,
-					ReadOnly: readOnly,
-				})
-			}
-			return volumes
-		}
-
-		// if volume is subpath of container path
-		if strings.HasPrefix(volumes[i].Target, containerDir) {
-			volumes[i].Source = hostDir
-			volumes[i].Target = containerDir
-			return volumes
-		}
-	}
-
-	return append(volumes, mount.Mount{
-		Type:     mount.TypeBind,
-		Source:   hostDir,
-		Target:   containerDir,
-		ReadOnly: readOnly,
-	})
-}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/labbcb/rnnr/proto"
+)
+
+func TestReadPull(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   *proto.PullProgress
+		err    string
+	}{
+		{
+			name: "image up to date",
+			stream: `{"status":"Pulling from library/ubuntu","id":"22.04"}
+{"status":"Digest: ` + testDigest + `"}
+{"status":"Status: Image is up to date for ubuntu:22.04"}`,
+			want: &proto.PullProgress{Status: "Status: Image is up to date for ubuntu:22.04"},
+		},
+		{
+			name: "layers are summed and completed",
+			stream: `{"status":"Pulling fs layer","id":"a"}
+{"status":"Downloading","progressDetail":{"current":10,"total":100},"id":"a"}
+{"status":"Downloading","progressDetail":{"current":20,"total":50},"id":"b"}
+{"status":"Download complete","id":"a"}
+{"status":"Extracting","progressDetail":{"current":5,"total":100},"id":"a"}
+{"status":"Status: Downloaded newer image for ubuntu:22.04"}`,
+			want: &proto.PullProgress{Status: "Status: Downloaded newer image for ubuntu:22.04", Current: 120, Total: 150},
+		},
+		{
+			name: "error in stream",
+			stream: `{"status":"Pulling from library/ubuntu","id":"22.04"}
+{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}`,
+			err: "manifest unknown",
+		},
+		{
+			name:   "invalid stream",
+			stream: `{"status":`,
+			err:    "unexpected EOF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var last *proto.PullProgress
+			err := readPull(strings.NewReader(tt.stream), func(p *proto.PullProgress) { last = p })
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("got error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last.Status != tt.want.Status || last.Current != tt.want.Current || last.Total != tt.want.Total {
+				t.Errorf("got progress %v, want %v", last, tt.want)
+			}
+		})
+	}
+
+	if err := readPull(strings.NewReader(`{"status":"Pulling"}`), nil); err != nil {
+		t.Errorf("got error %v without progress function", err)
+	}
+}
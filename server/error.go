@@ -4,3 +4,13 @@ package server
 type NetworkError struct {
 	error
 }
+
+// ContainerNotFound is returned by container runtimes when a container does not exist.
+type ContainerNotFound struct {
+	error
+}
+
+// InvalidTask error is returned when a submitted task is not valid or not supported.
+type InvalidTask struct {
+	error
+}
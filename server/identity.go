@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/labbcb/rnnr/models"
+)
+
+// UserMetadata is the task log metadata key of the UID and GID that ran the task container.
+const UserMetadata = "user"
+
+// UserMap maps task owners and tags to the UID and GID that run task containers.
+type UserMap struct {
+	owners map[string]string
+	tags   []tagUser
+}
+
+type tagUser struct {
+	key, value, user string
+}
+
+// LoadUserMap reads a user mapping file.
+// Each line has a task owner, or a tag as key=value, and a UID:GID separated by white space.
+// GID is required, otherwise tasks would run with the default group of workers.
+// Owner * matches every task. Owners are matched before tags, and tags in file order.
+// Empty lines and lines starting with # are ignored.
+//
+//	alice          1001:1001
+//	project=exome  2001:2001
+func LoadUserMap(file string) (*UserMap, error) {
+	lines, err := readLines(file)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &UserMap{owners: make(map[string]string)}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: expected task owner or tag and UID:GID in each line", file)
+		}
+		if _, _, err := parseUser(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if kv := strings.SplitN(fields[0], "=", 2); len(kv) == 2 {
+			m.tags = append(m.tags, tagUser{kv[0], kv[1], fields[1]})
+		} else {
+			m.owners[fields[0]] = fields[1]
+		}
+	}
+	return m, nil
+}
+
+// Lookup returns the UID:GID of task, or an empty string if it is not mapped.
+func (m *UserMap) Lookup(t *models.Task) string {
+	if m == nil {
+		return ""
+	}
+	if user, ok := m.owners[t.Owner]; ok && t.Owner != "" {
+		return user
+	}
+	for _, tag := range m.tags {
+		if v, ok := t.Tags[tag.key]; ok && v == tag.value {
+			return tag.user
+		}
+	}
+	return m.owners[anyUser]
+}
+
+// parseUser parses numeric UID:GID.
+func parseUser(s string) (uid, gid int64, err error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid user %q: expected numeric UID:GID", s)
+	}
+	uid, err = strconv.ParseInt(parts[0], 10, 32)
+	if err != nil || uid < 0 {
+		return 0, 0, fmt.Errorf("invalid user %q: expected numeric UID:GID", s)
+	}
+	gid, err = strconv.ParseInt(parts[1], 10, 32)
+	if err != nil || gid < 0 {
+		return 0, 0, fmt.Errorf("invalid user %q: expected numeric UID:GID", s)
+	}
+	return uid, gid, nil
+}
+
+// IDRanges are ranges of UIDs or GIDs, like 1000-1999.
+type IDRanges [][2]int64
+
+// ParseIDRanges parses IDs and ranges of IDs.
+func ParseIDRanges(ss []string) (IDRanges, error) {
+	var ranges IDRanges
+	for _, s := range ss {
+		for _, r := range strings.Split(s, ",") {
+			bounds := strings.SplitN(strings.TrimSpace(r), "-", 2)
+			first, err := strconv.ParseInt(bounds[0], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ID range %q", r)
+			}
+			last := first
+			if len(bounds) == 2 {
+				if last, err = strconv.ParseInt(bounds[1], 10, 32); err != nil || last < first {
+					return nil, fmt.Errorf("invalid ID range %q", r)
+				}
+			}
+			ranges = append(ranges, [2]int64{first, last})
+		}
+	}
+	return ranges, nil
+}
+
+// Contains returns true if id is in any range.
+func (rs IDRanges) Contains(id int64) bool {
+	for _, r := range rs {
+		if id >= r[0] && id <= r[1] {
+			return true
+		}
+	}
+	return false
+}
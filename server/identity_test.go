@@ -0,0 +1,130 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/labbcb/rnnr/models"
+)
+
+func TestParseUser(t *testing.T) {
+	tests := []struct {
+		user     string
+		uid, gid int64
+		fail     bool
+	}{
+		{user: "1001:1002", uid: 1001, gid: 1002},
+		{user: "0:0", uid: 0, gid: 0},
+		{user: "1001", fail: true},
+		{user: "1001:", fail: true},
+		{user: ":1001", fail: true},
+		{user: "-1:1001", fail: true},
+		{user: "1001:-1", fail: true},
+		{user: "alice:users", fail: true},
+		{user: "1001:1002:1003", fail: true},
+		{user: "4294967296:1001", fail: true},
+		{user: "", fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			uid, gid, err := parseUser(tt.user)
+			switch {
+			case tt.fail && err == nil:
+				t.Errorf("got %d:%d, want error", uid, gid)
+			case !tt.fail && err != nil:
+				t.Errorf("got error %v", err)
+			case !tt.fail && (uid != tt.uid || gid != tt.gid):
+				t.Errorf("got %d:%d, want %d:%d", uid, gid, tt.uid, tt.gid)
+			}
+		})
+	}
+}
+
+func TestUserMapLookup(t *testing.T) {
+	m, err := LoadUserMap(writeFile(t, `# owner or tag   UID:GID
+alice             1001:1001
+project=exome     2001:2001
+project=rna       2002:2002
+*                 3000:3000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		task *models.Task
+		want string
+	}{
+		{name: "owner", task: &models.Task{Owner: "alice", Tags: map[string]string{"project": "exome"}}, want: "1001:1001"},
+		{name: "tag", task: &models.Task{Owner: "bob", Tags: map[string]string{"project": "exome"}}, want: "2001:2001"},
+		{name: "other tag value", task: &models.Task{Owner: "bob", Tags: map[string]string{"project": "rna"}}, want: "2002:2002"},
+		{name: "any owner", task: &models.Task{Owner: "bob"}, want: "3000:3000"},
+		{name: "without owner", task: &models.Task{}, want: "3000:3000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := m.Lookup(tt.task); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	var none *UserMap
+	if got := none.Lookup(&models.Task{Owner: "alice"}); got != "" {
+		t.Errorf("got %q without user map", got)
+	}
+	m, err = LoadUserMap(writeFile(t, "alice 1001:1001\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Lookup(&models.Task{Owner: "bob"}); got != "" {
+		t.Errorf("got %q for unmapped owner", got)
+	}
+}
+
+func TestLoadUserMapInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"missing GID", "alice 1001\n"},
+		{"negative UID", "alice -1:1001\n"},
+		{"user names", "alice alice:users\n"},
+		{"missing user", "alice\n"},
+		{"extra field", "alice 1001:1001 extra\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadUserMap(writeFile(t, tt.content)); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestParseIDRanges(t *testing.T) {
+	ranges, err := ParseIDRanges([]string{"0", "1000-1999", "3000, 4000-4001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[int64]bool{
+		0: true, 1: false, 999: false, 1000: true, 1999: true, 2000: false,
+		3000: true, 3001: false, 4000: true, 4001: true, 4002: false, -1: false,
+	}
+	for id, want := range tests {
+		if got := ranges.Contains(id); got != want {
+			t.Errorf("Contains(%d) = %t, want %t", id, got, want)
+		}
+	}
+
+	var none IDRanges
+	if none.Contains(0) {
+		t.Error("empty ranges contain 0")
+	}
+
+	for _, s := range []string{"-1", "1999-1000", "1000-", "a-b", "1000-2000-3000", "", "4294967296"} {
+		if r, err := ParseIDRanges([]string{s}); err == nil {
+			t.Errorf("got ranges %v parsing %q, want error", r, s)
+		}
+	}
+}
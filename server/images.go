@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+)
+
+// ImageUsage keeps when worker last used images, by image reference, in a JSON file.
+// Images are used when worker pulls them or runs containers with them.
+// Only images used by worker are pruned, so that other images on the node are kept.
+type ImageUsage struct {
+	file string
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// NewImageUsage loads image usage from file, if it exists.
+func NewImageUsage(file string) (*ImageUsage, error) {
+	u := &ImageUsage{file: file, used: make(map[string]time.Time)}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &u.used); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Touch records that image was used now.
+func (u *ImageUsage) Touch(image string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.used[imageRef(image)] = time.Now()
+	return u.save()
+}
+
+// LastUsed returns when an image with any of refs was last used, and false if it was never used.
+func (u *ImageUsage) LastUsed(refs []string) (time.Time, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var last time.Time
+	for _, ref := range refs {
+		if t, ok := u.used[imageRef(ref)]; ok && t.After(last) {
+			last = t
+		}
+	}
+	return last, !last.IsZero()
+}
+
+// Forget removes usage of images with refs, after they were removed.
+func (u *ImageUsage) Forget(refs []string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, ref := range refs {
+		delete(u.used, imageRef(ref))
+	}
+	return u.save()
+}
+
+func (u *ImageUsage) save() error {
+	b, err := json.Marshal(u.used)
+	if err != nil {
+		return err
+	}
+	tmp := u.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.file)
+}
+
+// ImagePolicy restricts images of submitted tasks.
+type ImagePolicy struct {
+	// RequireDigest rejects images that are not referenced by digest, like ubuntu@sha256:...
+	RequireDigest bool
+	// Registries are the registries images may come from, all registries if empty.
+	// They may have a repository path, like quay.io/biocontainers.
+	Registries []string
+}
+
+// Check returns an error if image is not allowed.
+// Images that are not Docker image references, like local SIF files, are not allowed by any restriction.
+func (p *ImagePolicy) Check(image string) error {
+	if !p.RequireDigest && len(p.Registries) == 0 {
+		return nil
+	}
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(image, "docker://"))
+	if err != nil {
+		return fmt.Errorf("image %s is not a Docker image reference: %w", image, err)
+	}
+	if _, ok := named.(reference.Canonical); p.RequireDigest && !ok {
+		return fmt.Errorf("image %s must be referenced by digest, like %s@sha256:...", image, reference.FamiliarName(named))
+	}
+	if len(p.Registries) == 0 {
+		return nil
+	}
+	for _, registry := range p.Registries {
+		parts := strings.SplitN(strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://"), "/", 2)
+		prefix := registryDomain(parts[0])
+		if len(parts) == 2 && strings.Trim(parts[1], "/") != "" {
+			prefix += "/" + strings.Trim(parts[1], "/")
+		}
+		if named.Name() == prefix || strings.HasPrefix(named.Name(), prefix+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("image %s is not from allowed registries %v", image, p.Registries)
+}
+
+// imageRef normalizes image references so that equivalent ones are equal, like ubuntu and docker.io/library/ubuntu:latest.
+// References that are not Docker image references are returned as they are.
+func imageRef(image string) string {
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(image, "docker://"))
+	if err != nil {
+		return image
+	}
+	return reference.FamiliarString(reference.TagNameOnly(named))
+}
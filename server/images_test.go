@@ -0,0 +1,62 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestImagePolicyCheck(t *testing.T) {
+	digest := "@" + testDigest
+	tests := []struct {
+		name   string
+		policy ImagePolicy
+		image  string
+		err    string
+	}{
+		{name: "no restrictions", image: "/images/tool.sif"},
+		{name: "digest required", policy: ImagePolicy{RequireDigest: true}, image: "ubuntu" + digest},
+		{name: "digest required with tag", policy: ImagePolicy{RequireDigest: true}, image: "ubuntu:22.04" + digest},
+		{name: "digest required with docker prefix", policy: ImagePolicy{RequireDigest: true}, image: "docker://ubuntu" + digest},
+		{name: "digest missing", policy: ImagePolicy{RequireDigest: true}, image: "ubuntu:22.04", err: "image ubuntu:22.04 must be referenced by digest, like ubuntu@sha256:..."},
+		{name: "SIF file with restrictions", policy: ImagePolicy{RequireDigest: true}, image: "/images/tool.sif", err: "image /images/tool.sif is not a Docker image reference"},
+		{name: "registry", policy: ImagePolicy{Registries: []string{"quay.io"}}, image: "quay.io/biocontainers/samtools:1.15"},
+		{name: "registry URL", policy: ImagePolicy{Registries: []string{"https://quay.io/"}}, image: "quay.io/biocontainers/samtools:1.15"},
+		{name: "repository path", policy: ImagePolicy{Registries: []string{"quay.io/biocontainers/"}}, image: "quay.io/biocontainers/samtools:1.15"},
+		{name: "repository path is a prefix of components", policy: ImagePolicy{Registries: []string{"quay.io/bio"}}, image: "quay.io/biocontainers/samtools:1.15", err: "image quay.io/biocontainers/samtools:1.15 is not from allowed registries [quay.io/bio]"},
+		{name: "Docker Hub", policy: ImagePolicy{Registries: []string{"docker.io"}}, image: "ubuntu"},
+		{name: "Docker Hub registry domain", policy: ImagePolicy{Registries: []string{"registry-1.docker.io/"}}, image: "ubuntu"},
+		{name: "Docker Hub official images", policy: ImagePolicy{Registries: []string{"docker.io/library"}}, image: "ubuntu:22.04"},
+		{name: "Docker Hub user images are not official", policy: ImagePolicy{Registries: []string{"docker.io/library"}}, image: "labbcb/tool", err: "image labbcb/tool is not from allowed registries [docker.io/library]"},
+		{name: "other registry", policy: ImagePolicy{Registries: []string{"quay.io", "ghcr.io/labbcb"}}, image: "ubuntu", err: "image ubuntu is not from allowed registries [quay.io ghcr.io/labbcb]"},
+		{name: "registry domain is not a prefix", policy: ImagePolicy{Registries: []string{"quay.io"}}, image: "quay.io.example/tool", err: "image quay.io.example/tool is not from allowed registries [quay.io]"},
+		{name: "digest and registry", policy: ImagePolicy{RequireDigest: true, Registries: []string{"ghcr.io"}}, image: "ghcr.io/labbcb/tool" + digest},
+		{name: "digest from other registry", policy: ImagePolicy{RequireDigest: true, Registries: []string{"ghcr.io"}}, image: "ubuntu" + digest, err: "image ubuntu" + digest + " is not from allowed registries [ghcr.io]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(tt.image)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("got error %v", err)
+			case tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)):
+				t.Errorf("got error %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestImageRef(t *testing.T) {
+	tests := map[string]string{
+		"ubuntu":                             "ubuntu:latest",
+		"docker.io/library/ubuntu:latest":    "ubuntu:latest",
+		"docker://ubuntu:22.04":              "ubuntu:22.04",
+		"quay.io/biocontainers/samtools:1.1": "quay.io/biocontainers/samtools:1.1",
+		"ubuntu@" + testDigest:               "ubuntu@" + testDigest,
+		"/images/tool.sif":                   "/images/tool.sif",
+	}
+	for image, want := range tests {
+		if got := imageRef(image); got != want {
+			t.Errorf("imageRef(%q) = %q, want %q", image, got, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/labbcb/rnnr/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Local runs task commands directly as worker child processes, without any container engine.
+// Images are ignored and commands run as the worker user.
+// Input and output paths must be the same on host and in task, since nothing is mounted.
+// Containers are limited to requested CPU cores and memory with cgroup v2 if available.
+type Local struct {
+	*processes
+	sandbox *cgroupSandbox
+}
+
+// LocalConnect creates a local runtime that keeps containers in dir.
+func LocalConnect(dir string) (*Local, error) {
+	p, err := newProcesses(filepath.Join(dir, "containers"))
+	if err != nil {
+		return nil, err
+	}
+
+	sandbox, err := newCgroupSandbox()
+	if err != nil {
+		log.WithError(err).Warn("CPU and memory of tasks will not be limited.")
+	}
+	return &Local{processes: p, sandbox: sandbox}, nil
+}
+
+// Run starts task command in its working directory, or in container directory if it is not defined.
+func (l *Local) Run(_ context.Context, container *proto.Container) error {
+	if container.User != "" {
+		return errors.New("local runtime runs tasks as the worker user")
+	}
+	for _, v := range append(container.Inputs, container.Outputs...) {
+		if filepath.Clean(v.HostPath) != filepath.Clean(v.ContainerPath) {
+			return fmt.Errorf("local runtime requires same host and task paths, got %s and %s", v.HostPath, v.ContainerPath)
+		}
+	}
+	for _, output := range container.Outputs {
+		if err := os.MkdirAll(filepath.Dir(output.HostPath), 0755); err != nil {
+			return err
+		}
+	}
+
+	env := os.Environ()
+	for k, v := range container.Env {
+		env = append(env, k+"="+v)
+	}
+	// Scratch directory is not mounted, tasks find it with TMPDIR.
+	env = append(env, scratchEnv(container, container.Scratch)...)
+	spec := processSpec{
+		command: container.Command,
+		workDir: container.WorkDir,
+		env:     env,
+		stdin:   container.Stdin,
+		stdout:  container.Stdout,
+		stderr:  container.Stderr,
+	}
+	if spec.workDir == "" {
+		spec.workDir = l.path(container.Id)
+	}
+
+	if l.sandbox != nil {
+		cgroup, err := l.sandbox.create(container.Id, container.CpuCores, container.RamGb)
+		if err != nil {
+			log.WithError(err).WithField("id", container.Id).Warn("Unable to limit CPU and memory of container.")
+		}
+		spec.cgroup = cgroup
+	}
+
+	return l.start(container.Id, spec)
+}
+
+// Pull does nothing because images are not used.
+func (l *Local) Pull(context.Context, string, PullPolicy, func(*proto.PullProgress)) (string, error) {
+	return "", nil
+}
+
+// Exec is not supported because there is no container to execute commands in.
+func (l *Local) Exec(context.Context, string, []string, uint, uint) (ExecSession, error) {
+	return nil, status.Error(codes.Unimplemented, "local runtime does not support executing commands in containers")
+}
+
+// RemoveContainer kills container processes and removes its directory and cgroup.
+func (l *Local) RemoveContainer(ctx context.Context, id string) {
+	l.processes.RemoveContainer(ctx, id)
+	if l.sandbox == nil {
+		return
+	}
+	// Killed processes leave the cgroup shortly after.
+	for i := 0; ; i++ {
+		err := l.sandbox.remove(id)
+		if err == nil {
+			return
+		}
+		if i == 10 {
+			log.WithError(err).WithField("id", id).Warn("Unable to remove container cgroup.")
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
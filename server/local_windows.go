@@ -0,0 +1,8 @@
+package server
+
+import "errors"
+
+// LocalConnect fails because local processes are tracked with Unix sessions and signals.
+func LocalConnect(string) (Runtime, error) {
+	return nil, errors.New("local runtime is not supported on Windows")
+}
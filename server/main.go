@@ -5,9 +5,13 @@ import (
 	"sync"
 	"time"
 
+	units "github.com/docker/go-units"
 	"github.com/gorilla/mux"
 	"github.com/labbcb/rnnr/models"
+	"github.com/labbcb/rnnr/proto"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Main is a main instance.
@@ -15,6 +19,24 @@ type Main struct {
 	Router      *mux.Router
 	DB          *DB
 	ServiceInfo *models.ServiceInfo
+	// ArchiveDir is the directory where purged tasks are archived. Tasks are not archived if empty.
+	ArchiveDir string
+	// Authenticators identify callers. Requests must be authenticated by any of them.
+	// Authentication is disabled if empty.
+	Authenticators []Authenticator
+	// Roles of authenticated users. Authenticated users can do everything if nil.
+	Roles Roles
+	// Workers keeps connections with worker nodes.
+	Workers *WorkerPool
+	// ImagePolicy restricts images of submitted tasks.
+	ImagePolicy ImagePolicy
+	// SecurityPolicy defines relaxations of worker security profiles that tasks may request.
+	SecurityPolicy SecurityPolicy
+	// Users maps task owners and tags to the users that run task containers. Workers use their own user if nil.
+	Users *UserMap
+
+	watchers watchers
+	images   nodeImages
 }
 
 // NewMain creates a server and initializes Task and Node endpoints.
@@ -26,30 +48,42 @@ func NewMain(database string, sleepTime time.Duration) (*Main, error) {
 		return nil, fmt.Errorf("connecting to MongoDB: %w", err)
 	}
 
+	now := time.Now()
 	main := &Main{
-		Router: mux.NewRouter(),
-		DB:     connection,
+		Router:  mux.NewRouter(),
+		DB:      connection,
+		Workers: NewWorkerPool(),
 		ServiceInfo: &models.ServiceInfo{
 			ID:   "rnnr",
 			Name: "RNNR",
 			Type: &models.ServiceType{
-				Group:    "org.bcblab",
+				Group:    "org.ga4gh",
 				Artifact: "tes",
-				Version:  "1.0.0",
+				Version:  "1.1.0",
 			},
 			Description: "Distributed task execution system for scaling reproducible workflows",
-			Storage:     []string{"Local", "NFS"},
-			UpdatedAt:   time.Now(),
-			Version:     "1.4.1",
+			Organization: &models.Organization{
+				Name: "BCBLab",
+				URL:  "https://bcblab.org",
+			},
+			ContactURL:                    "https://github.com/labbcb/rnnr/issues",
+			DocumentationURL:              "https://bcblab.org/rnnr",
+			Storage:                       []string{"Local", "NFS"},
+			CreatedAt:                     now,
+			UpdatedAt:                     now,
+			Version:                       "1.4.1",
+			TESResourcesBackendParameters: BackendParameters,
 		},
 	}
 	main.register()
 	go main.StartTaskManager(sleepTime)
+	go main.StartImageRefresher()
 	return main, nil
 }
 
 // StartTaskManager starts task management.
 // It will iterate over: 1) queued tasks; 2) initialized tasks; and 3) running tasks.
+// Running tasks are also updated as soon as active nodes stream container events.
 // Then it will sleepTime seconds and start over.
 func (m *Main) StartTaskManager(sleepTime time.Duration) {
 	for {
@@ -60,6 +94,9 @@ func (m *Main) StartTaskManager(sleepTime time.Duration) {
 			log.WithError(err).Warn("Unable to run tasks.")
 		}
 
+		if err := m.WatchNodes(); err != nil {
+			log.WithError(err).Warn("Unable to watch nodes.")
+		}
 		if err := m.CheckTasks(); err != nil {
 			log.WithError(err).Warn("Unable to check tasks.")
 		}
@@ -72,13 +109,13 @@ func (m *Main) StartTaskManager(sleepTime time.Duration) {
 // The selected node is assigned to perform the task. The task changes to the Initializing state.
 // If no active node has enough computing resources to perform the task the same is kept in queue.
 func (m *Main) InitializeTasks() error {
-	tasks, err := m.DB.ListTasks(0, 0, models.Full, nil, []models.State{models.Queued})
+	tasks, err := m.DB.ListTasks(0, nil, models.Full, &models.TaskFilter{States: []models.State{models.Queued}})
 	if err != nil {
 		return err
 	}
 
 	for _, task := range tasks {
-		node, err := m.RequestNode(task.Resources)
+		node, err := m.RequestNode(task.Resources, task.Executors[0].Image)
 		switch err.(type) {
 		case nil:
 			task.Host = node.Host
@@ -102,7 +139,7 @@ func (m *Main) InitializeTasks() error {
 
 // RunTasks tries to start initialized tasks.
 func (m *Main) RunTasks() error {
-	tasks, err := m.DB.ListTasks(0, 0, models.Full, nil, []models.State{models.Initializing})
+	tasks, err := m.DB.ListTasks(0, nil, models.Full, &models.TaskFilter{States: []models.State{models.Initializing}})
 	if err != nil {
 		return err
 	}
@@ -135,10 +172,27 @@ func (m *Main) RunTasks() error {
 }
 
 // RunTask remotely starts a task.
+// Image is pulled first, reporting progress in system logs while task is initializing.
 func (m *Main) RunTask(task *models.Task, node *models.Node, res chan<- *models.Task, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	switch err := RemoteRun(task, node.Address()).(type) {
+	pulled, err := m.pullImage(task, node)
+	if pulled {
+		m.images.add(node.Host, task.Executors[0].Image)
+		// Task may have been canceled while pulling.
+		if t, err := m.DB.GetTask(task.ID, models.Minimal); err == nil && t.State != models.Initializing {
+			log.WithFields(log.Fields{"id": task.ID, "state": t.State}).Info("Task changed while pulling image.")
+			return
+		}
+	}
+	if err == nil {
+		if user := m.Users.Lookup(task); user != "" {
+			setMetadata(task, UserMetadata, user)
+		}
+		err = m.Workers.RemoteRun(task, node.Address(), pulled)
+	}
+
+	switch err := err.(type) {
 	case nil:
 		task.State = models.Running
 		task.Metrics = &models.Metrics{}
@@ -156,25 +210,93 @@ func (m *Main) RunTask(task *models.Task, node *models.Node, res chan<- *models.
 	res <- task
 }
 
+// pullLogInterval limits how often pull progress is saved in task system logs.
+const pullLogInterval = 5 * time.Second
+
+// pullImage pulls task image on node.
+// Pull progress is the last system log line while pulling, and is kept if some layer was downloaded.
+// The resolved image digest is saved in task log metadata.
+func (m *Main) pullImage(task *models.Task, node *models.Node) (bool, error) {
+	image := task.Executors[0].Image
+	logs := task.Logs[0].SystemLogs
+	start := time.Now()
+	var saved time.Time
+	var last *proto.PullProgress
+	var digest string
+	pulled, err := m.Workers.RemotePull(task, node.Address(), func(p *proto.PullProgress) {
+		if p.Digest != "" {
+			digest = p.Digest
+			return
+		}
+		last = p
+		if time.Since(saved) < pullLogInterval {
+			return
+		}
+		saved = time.Now()
+		line := pullLog(image, p)
+		if err := m.DB.UpdateSystemLogs(task.ID, models.Initializing, append(logs[:len(logs):len(logs)], line)); err != nil {
+			log.WithError(err).WithField("id", task.ID).Warn("Unable to save pull progress.")
+		}
+	})
+	if err != nil {
+		if _, ok := err.(*NetworkError); !ok {
+			err = fmt.Errorf("unable to pull image %s: %w", image, err)
+		}
+		return false, err
+	}
+	if last != nil && last.Total > 0 {
+		task.Logs[0].SystemLogs = append(logs, fmt.Sprintf("Pulled image %s (%s) in %s.", image, units.HumanSize(float64(last.Total)), time.Since(start).Round(time.Second)))
+	}
+	if digest != "" {
+		setMetadata(task, ImageDigestMetadata, digest)
+	}
+	return pulled, nil
+}
+
+// setMetadata sets a metadata value of the task log.
+func setMetadata(task *models.Task, key, value string) {
+	if task.Logs[0].Metadata == nil {
+		task.Logs[0].Metadata = make(map[string]string)
+	}
+	task.Logs[0].Metadata[key] = value
+}
+
+// pullLog describes pull progress.
+func pullLog(image string, p *proto.PullProgress) string {
+	if p.Total == 0 {
+		return fmt.Sprintf("Pulling image %s: %s", image, p.Status)
+	}
+	return fmt.Sprintf("Pulling image %s: %s of %s", image, units.HumanSize(float64(p.Current)), units.HumanSize(float64(p.Total)))
+}
+
 // CheckTasks will iterate over running tasks checking if they have been completed well or not.
-// It runs concurrently.
+// Tasks of each node are checked with a single request. Nodes are checked concurrently.
+// Tasks of nodes streaming container events are checked less often.
 func (m *Main) CheckTasks() error {
-	tasks, err := m.DB.ListTasks(0, 0, models.Full, nil, []models.State{models.Running})
+	tasks, err := m.DB.ListTasks(0, nil, models.Full, &models.TaskFilter{States: []models.State{models.Running}})
 	if err != nil {
 		return err
 	}
 
+	byHost := make(map[string][]*models.Task)
+	for _, task := range tasks {
+		byHost[task.Host] = append(byHost[task.Host], task)
+	}
+
 	ch := make(chan *models.Task)
 	wg := &sync.WaitGroup{}
-	wg.Add(len(tasks))
-	for _, task := range tasks {
-		node, err := m.DB.GetNode(task.Host)
+	for host, tasks := range byHost {
+		if w := m.watchers.get(host); w != nil && !w.needsCheck() {
+			continue
+		}
+		node, err := m.DB.GetNode(host)
 		if err != nil {
-			log.WithFields(log.Fields{"id": task.ID, "name": task.Name, "host": task.Host}).Error("Unable to get node.")
+			log.WithFields(log.Fields{"host": host, "tasks": len(tasks)}).Error("Unable to get node.")
 			continue
 		}
 
-		go CheckTask(task, node, ch, wg)
+		wg.Add(1)
+		go m.CheckNodeTasks(tasks, node, ch, wg)
 	}
 
 	go func() {
@@ -191,11 +313,49 @@ func (m *Main) CheckTasks() error {
 	return nil
 }
 
+// CheckNodeTasks remotely checks running tasks of a node in a single request.
+// Tasks are checked one by one if worker does not support checking containers in batch.
+// If the request fails tasks are kept running and checked again later,
+// only tasks whose containers are missing from a successful response fail.
+func (m *Main) CheckNodeTasks(tasks []*models.Task, node *models.Node, res chan<- *models.Task, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	states, err := m.Workers.RemoteCheckAll(tasks, node.Address())
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+		wg.Add(len(tasks))
+		for _, task := range tasks {
+			go m.CheckTask(task, node, res, wg)
+		}
+		return
+	case err != nil:
+		log.WithError(err).WithFields(log.Fields{"host": node.Host, "tasks": len(tasks)}).Warn("Unable to check tasks of node.")
+		return
+	}
+
+	for _, task := range tasks {
+		var taskErr error
+		if state, ok := states[task.ID]; ok {
+			updateTaskState(task, state)
+		} else {
+			taskErr = fmt.Errorf("container of task %s not found", task.ID)
+		}
+		checked(task, taskErr)
+		res <- task
+	}
+}
+
 // CheckTask remotely check a running task.
-func CheckTask(task *models.Task, node *models.Node, res chan<- *models.Task, wg *sync.WaitGroup) {
+func (m *Main) CheckTask(task *models.Task, node *models.Node, res chan<- *models.Task, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	switch err := RemoteCheck(task, node.Address()).(type) {
+	checked(task, m.Workers.RemoteCheck(task, node.Address()))
+	res <- task
+}
+
+// checked updates task after it has been checked.
+func checked(task *models.Task, err error) {
+	switch err := err.(type) {
 	case nil:
 		if task.State != models.Running {
 			now := time.Now()
@@ -209,6 +369,4 @@ func CheckTask(task *models.Task, node *models.Node, res chan<- *models.Task, wg
 		task.Logs[0].SystemLogs = append(task.Logs[0].SystemLogs, err.Error())
 		log.WithError(err).WithFields(log.Fields{"id": task.ID, "name": task.Name, "host": task.Host, "state": task.State}).Error("Unable to check task.")
 	}
-
-	res <- task
 }
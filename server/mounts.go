@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/labbcb/rnnr/proto"
+)
+
+// mountRequest is a host path that must be reachable at a container path, by bind-mounting source at target.
+type mountRequest struct {
+	kind           string
+	host, path     string
+	source, target string
+	readOnly       bool
+}
+
+// mounts returns bind mounts of worker volumes, task inputs and outputs, and scratch directory.
+// Inputs are mounted read-only where they are. Outputs may not exist yet, so their parent directories are mounted,
+// and output file names must be the same on host and in container.
+// Paths are compared by components, so /data/a does not contain /data/ab.
+// It returns an error if some path cannot be reached as requested, like two host directories at the same container path,
+// or an output inside a read-only input.
+func mounts(workerVolumes []string, t *proto.Container) ([]mount.Mount, error) {
+	var reqs []*mountRequest
+	add := func(kind, host, containerPath string, readOnly, output bool) error {
+		if !filepath.IsAbs(host) {
+			return fmt.Errorf("%s %s: host path %q is not absolute", kind, containerPath, host)
+		}
+		if !path.IsAbs(containerPath) {
+			return fmt.Errorf("%s %s: container path is not absolute", kind, containerPath)
+		}
+		r := &mountRequest{
+			kind:     kind,
+			host:     filepath.Clean(host),
+			path:     path.Clean(containerPath),
+			readOnly: readOnly,
+		}
+		r.source, r.target = r.host, r.path
+		if output {
+			r.source, r.target = filepath.Dir(r.host), path.Dir(r.path)
+		}
+		if r.target == "/" {
+			return fmt.Errorf("%s %s: cannot mount %s over container root", kind, containerPath, r.source)
+		}
+		reqs = append(reqs, r)
+		return nil
+	}
+
+	for _, v := range workerVolumes {
+		if err := add("volume", v, v, false, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, output := range t.Outputs {
+		if err := add("output", output.HostPath, output.ContainerPath, false, true); err != nil {
+			return nil, err
+		}
+	}
+	for _, input := range t.Inputs {
+		if err := add("input", input.HostPath, input.ContainerPath, true, false); err != nil {
+			return nil, err
+		}
+	}
+	if t.Scratch != "" {
+		if err := add("scratch", t.Scratch, ScratchPath, false, false); err != nil {
+			return nil, err
+		}
+	}
+	return planMounts(reqs)
+}
+
+// planMounts returns the fewest bind mounts that satisfy requests, parents before the mounts inside them.
+// Requests already reachable through a parent mount with the same access are not mounted again.
+// A mount at the same target as another must have the same source, and it is read-only only if both are.
+// A mount inside a read-only mount must have the matching source, since its mount point cannot be created.
+func planMounts(reqs []*mountRequest) ([]mount.Mount, error) {
+	sorted := make([]*mountRequest, len(reqs))
+	copy(sorted, reqs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return depth(sorted[i].target) < depth(sorted[j].target)
+	})
+
+	var plan []*mount.Mount
+	for _, r := range sorted {
+		parent := mountOf(plan, r.target)
+		switch {
+		case parent == nil:
+		case parent.Target == r.target:
+			if parent.Source != r.source {
+				return nil, fmt.Errorf("%s %s: %s is mounted from both %s and %s", r.kind, r.path, r.target, parent.Source, r.source)
+			}
+			parent.ReadOnly = parent.ReadOnly && r.readOnly
+			continue
+		case hostPathAt(parent, r.target) == r.source:
+			if parent.ReadOnly == r.readOnly {
+				continue
+			}
+		case parent.ReadOnly:
+			return nil, fmt.Errorf("%s %s: cannot mount %s inside read-only %s mounted from %s", r.kind, r.path, r.source, parent.Target, parent.Source)
+		}
+		plan = append(plan, &mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   r.source,
+			Target:   r.target,
+			ReadOnly: r.readOnly,
+		})
+	}
+
+	// Mounts inside others may hide what was requested at their parents.
+	for _, r := range reqs {
+		m := mountOf(plan, r.path)
+		if host := hostPathAt(m, r.path); host != r.host {
+			return nil, fmt.Errorf("%s %s: path would be %s from %s mounted at %s, not %s", r.kind, r.path, host, m.Source, m.Target, r.host)
+		}
+		if !r.readOnly && m.ReadOnly {
+			return nil, fmt.Errorf("%s %s: path is inside read-only %s mounted from %s", r.kind, r.path, m.Target, m.Source)
+		}
+	}
+
+	mounts := make([]mount.Mount, len(plan))
+	for i, m := range plan {
+		mounts[i] = *m
+	}
+	return mounts, nil
+}
+
+// mountOf returns the mount with the deepest target that contains container path p, or nil.
+func mountOf(plan []*mount.Mount, p string) *mount.Mount {
+	var found *mount.Mount
+	for _, m := range plan {
+		if containsPath(m.Target, p) && (found == nil || depth(m.Target) > depth(found.Target)) {
+			found = m
+		}
+	}
+	return found
+}
+
+// hostPathAt returns the host path of container path p inside mount m.
+func hostPathAt(m *mount.Mount, p string) string {
+	return filepath.Join(m.Source, filepath.FromSlash(strings.TrimPrefix(p, m.Target)))
+}
+
+// containsPath tells whether container path p is dir or is inside it.
+func containsPath(dir, p string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// depth returns the number of components of a clean absolute container path.
+func depth(p string) int {
+	return strings.Count(p, "/")
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/labbcb/rnnr/proto"
+)
+
+func TestMounts(t *testing.T) {
+	tests := []struct {
+		name    string
+		volumes []string
+		inputs  []*proto.Volume
+		outputs []*proto.Volume
+		scratch string
+		want    []string
+	}{
+		{
+			name: "nothing",
+		},
+		{
+			name:   "input is mounted read-only where it is",
+			inputs: []*proto.Volume{{HostPath: "/nfs/ref/hg38.fa", ContainerPath: "/ref/hg38.fa"}},
+			want:   []string{"/nfs/ref/hg38.fa:/ref/hg38.fa:ro"},
+		},
+		{
+			name: "inputs in the same directory are not widened to it",
+			inputs: []*proto.Volume{
+				{HostPath: "/nfs/ref/hg38.fa", ContainerPath: "/ref/hg38.fa"},
+				{HostPath: "/nfs/ref/hg38.fa.fai", ContainerPath: "/ref/hg38.fa.fai"},
+			},
+			want: []string{"/nfs/ref/hg38.fa:/ref/hg38.fa:ro", "/nfs/ref/hg38.fa.fai:/ref/hg38.fa.fai:ro"},
+		},
+		{
+			name: "input inside input directory from same host directory",
+			inputs: []*proto.Volume{
+				{HostPath: "/nfs/ref", ContainerPath: "/ref"},
+				{HostPath: "/nfs/ref/hg38.fa", ContainerPath: "/ref/hg38.fa"},
+			},
+			want: []string{"/nfs/ref:/ref:ro"},
+		},
+		{
+			name:    "output parent directory is mounted read-write",
+			outputs: []*proto.Volume{{HostPath: "/nfs/out/sample.bam", ContainerPath: "/out/sample.bam"}},
+			want:    []string{"/nfs/out:/out"},
+		},
+		{
+			name: "outputs in the same directory share a mount",
+			outputs: []*proto.Volume{
+				{HostPath: "/nfs/out/sample.bam", ContainerPath: "/out/sample.bam"},
+				{HostPath: "/nfs/out/sample.bam.bai", ContainerPath: "/out/sample.bam.bai"},
+			},
+			want: []string{"/nfs/out:/out"},
+		},
+		{
+			name: "output inside output directory from same host directory",
+			outputs: []*proto.Volume{
+				{HostPath: "/nfs/out/sample.bam", ContainerPath: "/out/sample.bam"},
+				{HostPath: "/nfs/out/qc/report.html", ContainerPath: "/out/qc/report.html"},
+			},
+			want: []string{"/nfs/out:/out"},
+		},
+		{
+			name: "output inside output directory from other host directory",
+			outputs: []*proto.Volume{
+				{HostPath: "/nfs/out/sample.bam", ContainerPath: "/out/sample.bam"},
+				{HostPath: "/scratch/qc/report.html", ContainerPath: "/out/qc/report.html"},
+			},
+			want: []string{"/nfs/out:/out", "/scratch/qc:/out/qc"},
+		},
+		{
+			name:    "sibling paths are not confused with prefixes",
+			inputs:  []*proto.Volume{{HostPath: "/nfs/ab/reads.fq", ContainerPath: "/data/ab/reads.fq"}},
+			outputs: []*proto.Volume{{HostPath: "/nfs/a/out.txt", ContainerPath: "/data/a/out.txt"}},
+			want:    []string{"/nfs/a:/data/a", "/nfs/ab/reads.fq:/data/ab/reads.fq:ro"},
+		},
+		{
+			name:    "input inside output directory stays read-only",
+			inputs:  []*proto.Volume{{HostPath: "/nfs/work/in.txt", ContainerPath: "/work/in.txt"}},
+			outputs: []*proto.Volume{{HostPath: "/nfs/work/out.txt", ContainerPath: "/work/out.txt"}},
+			want:    []string{"/nfs/work:/work", "/nfs/work/in.txt:/work/in.txt:ro"},
+		},
+		{
+			name:    "input inside output directory from other host directory",
+			inputs:  []*proto.Volume{{HostPath: "/nfs/ref/hg38.fa", ContainerPath: "/work/hg38.fa"}},
+			outputs: []*proto.Volume{{HostPath: "/nfs/work/out.txt", ContainerPath: "/work/out.txt"}},
+			want:    []string{"/nfs/work:/work", "/nfs/ref/hg38.fa:/work/hg38.fa:ro"},
+		},
+		{
+			name:    "output inside input directory from same host directory",
+			inputs:  []*proto.Volume{{HostPath: "/nfs/project", ContainerPath: "/project"}},
+			outputs: []*proto.Volume{{HostPath: "/nfs/project/results/out.txt", ContainerPath: "/project/results/out.txt"}},
+			want:    []string{"/nfs/project:/project:ro", "/nfs/project/results:/project/results"},
+		},
+		{
+			name:    "input directory that is also output directory is writable",
+			inputs:  []*proto.Volume{{HostPath: "/nfs/work", ContainerPath: "/work"}},
+			outputs: []*proto.Volume{{HostPath: "/nfs/work/out.txt", ContainerPath: "/work/out.txt"}},
+			want:    []string{"/nfs/work:/work"},
+		},
+		{
+			name:    "worker volume contains task paths",
+			volumes: []string{"/data"},
+			inputs:  []*proto.Volume{{HostPath: "/data/in.txt", ContainerPath: "/data/in.txt"}},
+			outputs: []*proto.Volume{{HostPath: "/data/results/out.txt", ContainerPath: "/data/results/out.txt"}},
+			want:    []string{"/data:/data", "/data/in.txt:/data/in.txt:ro"},
+		},
+		{
+			name:    "task paths inside worker volume from other host paths",
+			volumes: []string{"/data"},
+			outputs: []*proto.Volume{{HostPath: "/nfs/out/out.txt", ContainerPath: "/data/out/out.txt"}},
+			want:    []string{"/data:/data", "/nfs/out:/data/out"},
+		},
+		{
+			name:    "worker volume prefix of other path",
+			volumes: []string{"/data"},
+			outputs: []*proto.Volume{{HostPath: "/nfs/out/out.txt", ContainerPath: "/database/out.txt"}},
+			want:    []string{"/data:/data", "/nfs/out:/database"},
+		},
+		{
+			name:    "scratch directory",
+			scratch: "/local/scratch/task",
+			outputs: []*proto.Volume{{HostPath: "/nfs/out/out.txt", ContainerPath: "/out/out.txt"}},
+			want:    []string{"/nfs/out:/out", "/local/scratch/task:/scratch"},
+		},
+		{
+			name:    "paths are cleaned",
+			inputs:  []*proto.Volume{{HostPath: "/nfs//ref/./hg38.fa", ContainerPath: "/ref/../ref/hg38.fa"}},
+			outputs: []*proto.Volume{{HostPath: "/nfs/out/dir/", ContainerPath: "/out//dir/"}},
+			want:    []string{"/nfs/out:/out", "/nfs/ref/hg38.fa:/ref/hg38.fa:ro"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mounts(tt.volumes, &proto.Container{Inputs: tt.inputs, Outputs: tt.outputs, Scratch: tt.scratch})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(binds(got), " ") != strings.Join(tt.want, " ") {
+				t.Errorf("got mounts\n%v\nwant\n%v", binds(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestMountsConflicts(t *testing.T) {
+	tests := []struct {
+		name    string
+		volumes []string
+		inputs  []*proto.Volume
+		outputs []*proto.Volume
+		scratch string
+		want    string
+	}{
+		{
+			name:   "relative host path",
+			inputs: []*proto.Volume{{HostPath: "ref/hg38.fa", ContainerPath: "/ref/hg38.fa"}},
+			want:   `input /ref/hg38.fa: host path "ref/hg38.fa" is not absolute`,
+		},
+		{
+			name:   "missing host path",
+			inputs: []*proto.Volume{{ContainerPath: "/ref/hg38.fa"}},
+			want:   `input /ref/hg38.fa: host path "" is not absolute`,
+		},
+		{
+			name:    "relative container path",
+			outputs: []*proto.Volume{{HostPath: "/nfs/out/out.txt", ContainerPath: "out/out.txt"}},
+			want:    "output out/out.txt: container path is not absolute",
+		},
+		{
+			name:    "output at container root",
+			outputs: []*proto.Volume{{HostPath: "/nfs/out/out.txt", ContainerPath: "/out.txt"}},
+			want:    "output /out.txt: cannot mount /nfs/out over container root",
+		},
+		{
+			name:   "input at container root",
+			inputs: []*proto.Volume{{HostPath: "/nfs", ContainerPath: "/"}},
+			want:   "input /: cannot mount /nfs over container root",
+		},
+		{
+			name: "inputs at the same path from different host paths",
+			inputs: []*proto.Volume{
+				{HostPath: "/nfs/a/in.txt", ContainerPath: "/in/in.txt"},
+				{HostPath: "/nfs/b/in.txt", ContainerPath: "/in/in.txt"},
+			},
+			want: "input /in/in.txt: /in/in.txt is mounted from both /nfs/a/in.txt and /nfs/b/in.txt",
+		},
+		{
+			name: "outputs in the same directory from different host directories",
+			outputs: []*proto.Volume{
+				{HostPath: "/nfs/a/out.txt", ContainerPath: "/out/a.txt"},
+				{HostPath: "/nfs/b/out.txt", ContainerPath: "/out/b.txt"},
+			},
+			want: "output /out/b.txt: /out is mounted from both /nfs/a and /nfs/b",
+		},
+		{
+			name:    "output directory at input directory from other host directory",
+			inputs:  []*proto.Volume{{HostPath: "/nfs/in", ContainerPath: "/data"}},
+			outputs: []*proto.Volume{{HostPath: "/nfs/out/out.txt", ContainerPath: "/data/out.txt"}},
+			want:    "input /data: /data is mounted from both /nfs/out and /nfs/in",
+		},
+		{
+			name:    "output at input path",
+			inputs:  []*proto.Volume{{HostPath: "/nfs/work/data.txt", ContainerPath: "/work/data.txt"}},
+			outputs: []*proto.Volume{{HostPath: "/nfs/work/data.txt", ContainerPath: "/work/data.txt"}},
+			want:    "output /work/data.txt: path is inside read-only /work/data.txt mounted from /nfs/work/data.txt",
+		},
+		{
+			name:    "output shadowed by input from other host path",
+			inputs:  []*proto.Volume{{HostPath: "/nfs/ref/data.txt", ContainerPath: "/work/data.txt"}},
+			outputs: []*proto.Volume{{HostPath: "/nfs/work/data.txt", ContainerPath: "/work/data.txt"}},
+			want:    "output /work/data.txt: path would be /nfs/ref/data.txt from /nfs/ref/data.txt mounted at /work/data.txt, not /nfs/work/data.txt",
+		},
+		{
+			name:    "output inside read-only input directory from other host directory",
+			inputs:  []*proto.Volume{{HostPath: "/nfs/ref", ContainerPath: "/ref"}},
+			outputs: []*proto.Volume{{HostPath: "/nfs/index/hg38.fai", ContainerPath: "/ref/index/hg38.fai"}},
+			want:    "output /ref/index/hg38.fai: cannot mount /nfs/index inside read-only /ref mounted from /nfs/ref",
+		},
+		{
+			name:    "output file name differs from host file name",
+			outputs: []*proto.Volume{{HostPath: "/nfs/out/result.txt", ContainerPath: "/out/out.txt"}},
+			want:    "output /out/out.txt: path would be /nfs/out/out.txt from /nfs/out mounted at /out, not /nfs/out/result.txt",
+		},
+		{
+			name: "input inside read-only input from other host path",
+			inputs: []*proto.Volume{
+				{HostPath: "/nfs/ref", ContainerPath: "/ref"},
+				{HostPath: "/home/alice/extra.fa", ContainerPath: "/ref/extra.fa"},
+			},
+			want: "input /ref/extra.fa: cannot mount /home/alice/extra.fa inside read-only /ref mounted from /nfs/ref",
+		},
+		{
+			name:    "input at worker volume path",
+			volumes: []string{"/data"},
+			inputs:  []*proto.Volume{{HostPath: "/nfs/data", ContainerPath: "/data"}},
+			want:    "input /data: /data is mounted from both /data and /nfs/data",
+		},
+		{
+			name:    "input at scratch path",
+			scratch: "/local/scratch/task",
+			inputs:  []*proto.Volume{{HostPath: "/nfs/scratch", ContainerPath: "/scratch"}},
+			want:    "scratch /scratch: /scratch is mounted from both /nfs/scratch and /local/scratch/task",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mounts(tt.volumes, &proto.Container{Inputs: tt.inputs, Outputs: tt.outputs, Scratch: tt.scratch})
+			if err == nil {
+				t.Fatalf("got mounts %v, want error %q", binds(got), tt.want)
+			}
+			if !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("got error\n%v\nwant\n%v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMountsOrder(t *testing.T) {
+	got, err := mounts(nil, &proto.Container{
+		Inputs: []*proto.Volume{{HostPath: "/nfs/a/b/c/in.txt", ContainerPath: "/a/b/c/in.txt"}},
+		Outputs: []*proto.Volume{
+			{HostPath: "/nfs/x/a/b/out.txt", ContainerPath: "/a/b/out.txt"},
+			{HostPath: "/nfs/y/out.txt", ContainerPath: "/a/out.txt"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/nfs/y:/a", "/nfs/x/a/b:/a/b", "/nfs/a/b/c/in.txt:/a/b/c/in.txt:ro"}
+	if strings.Join(binds(got), " ") != strings.Join(want, " ") {
+		t.Errorf("got mounts\n%v\nwant parents first\n%v", binds(got), want)
+	}
+}
+
+// binds formats mounts like docker run --volume.
+func binds(mounts []mount.Mount) []string {
+	var bs []string
+	for _, m := range mounts {
+		b := fmt.Sprintf("%s:%s", m.Source, m.Target)
+		if m.ReadOnly {
+			b += ":ro"
+		}
+		bs = append(bs, b)
+	}
+	return bs
+}
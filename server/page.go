@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/labbcb/rnnr/models"
+)
+
+const (
+	// DefaultPageSize is the number of tasks returned when page size is not defined.
+	DefaultPageSize = 256
+	// MaxPageSize is the maximum number of tasks returned in a single page.
+	MaxPageSize = 2048
+)
+
+// PageToken is a cursor pointing to the last task of a page.
+// Tasks are listed by creation time and ID, so a token remains valid while new tasks are inserted.
+type PageToken struct {
+	Created time.Time `json:"c"`
+	ID      string    `json:"i"`
+}
+
+// InvalidPageToken error is returned when page token can not be decoded.
+type InvalidPageToken struct {
+	error
+}
+
+// NewPageToken creates a token pointing to given task.
+func NewPageToken(t *models.Task) *PageToken {
+	token := &PageToken{ID: t.ID}
+	if t.Created != nil {
+		token.Created = *t.Created
+	}
+	return token
+}
+
+// ParsePageToken decodes an opaque page token.
+func ParsePageToken(s string) (*PageToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, &InvalidPageToken{fmt.Errorf("invalid page token: %w", err)}
+	}
+
+	var token PageToken
+	if err := json.Unmarshal(b, &token); err != nil || token.ID == "" {
+		return nil, &InvalidPageToken{fmt.Errorf("invalid page token %q", s)}
+	}
+	return &token, nil
+}
+
+// String encodes token as an opaque URL-safe string.
+func (p *PageToken) String() string {
+	b, _ := json.Marshal(p)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
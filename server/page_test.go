@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/labbcb/rnnr/models"
+)
+
+func TestPageToken(t *testing.T) {
+	created := time.Date(2022, 3, 4, 5, 6, 7, 8, time.UTC)
+	tests := []struct {
+		name string
+		task *models.Task
+		want PageToken
+	}{
+		{
+			name: "task with creation time",
+			task: &models.Task{ID: "c8l2tlbdd1ag0a8j0u7g", Created: &created},
+			want: PageToken{Created: created, ID: "c8l2tlbdd1ag0a8j0u7g"},
+		},
+		{
+			name: "task without creation time",
+			task: &models.Task{ID: "c8l2tlbdd1ag0a8j0u7g"},
+			want: PageToken{ID: "c8l2tlbdd1ag0a8j0u7g"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePageToken(NewPageToken(tt.task).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Created.Equal(tt.want.Created) || got.ID != tt.want.ID {
+				t.Errorf("got token %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePageTokenInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"not base64", "not a token!"},
+		{"not JSON", base64.RawURLEncoding.EncodeToString([]byte("task"))},
+		{"wrong types", base64.RawURLEncoding.EncodeToString([]byte(`{"c":1,"i":"a"}`))},
+		{"without ID", base64.RawURLEncoding.EncodeToString([]byte(`{"c":"2022-03-04T05:06:07Z"}`))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePageToken(tt.token)
+			if err == nil {
+				t.Fatalf("got token %+v, want error", *got)
+			}
+			if _, ok := err.(*InvalidPageToken); !ok {
+				t.Errorf("got error %T, want *InvalidPageToken", err)
+			}
+		})
+	}
+}
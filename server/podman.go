@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/labbcb/rnnr/proto"
+)
+
+// Podman runs containers using the Docker-compatible API of Podman.
+// Rootless Podman requires the API service of the user to be running (systemctl --user start podman.socket).
+type Podman struct {
+	*Docker
+}
+
+// PodmanConnect connects to Podman socket.
+// CONTAINER_HOST environment variable overrides the default socket of the current user.
+func PodmanConnect(volumes []string, user, group string) (*Podman, error) {
+	d, err := dockerConnect(volumes, user, group, client.WithHost(podmanHost()))
+	if err != nil {
+		return nil, err
+	}
+	return &Podman{d}, nil
+}
+
+// podmanHost returns the socket of rootful Podman for root, or of rootless Podman for other users.
+func podmanHost() string {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && os.Geteuid() != 0 {
+		return "unix://" + filepath.Join(dir, "podman", "podman.sock")
+	}
+	return "unix:///run/podman/podman.sock"
+}
+
+// CheckAll returns the states of containers.
+// Podman matches name filters without the leading slash that Docker requires,
+// so managed containers are listed by label and selected by task ID.
+func (p *Podman) CheckAll(ctx context.Context, ids []string) (map[string]*proto.State, error) {
+	containers, err := p.listManaged(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return p.states(ctx, containers), nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	var selected []types.Container
+	for _, c := range containers {
+		if wanted[c.Labels[taskLabel]] {
+			selected = append(selected, c)
+		}
+	}
+	return p.states(ctx, selected), nil
+}
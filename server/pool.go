@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/labbcb/rnnr/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	_ "google.golang.org/grpc/health" // enables client-side health checking
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	// DefaultCallTimeout is the deadline of worker calls.
+	DefaultCallTimeout = 30 * time.Second
+	// DefaultRunTimeout is the deadline of starting a container, which includes pulling its image.
+	DefaultRunTimeout = time.Hour
+)
+
+// workerKeepalive pings idle connections so that dead workers are detected before the next call.
+// Workers must permit pings at least this frequent (see WorkerKeepalivePolicy).
+var workerKeepalive = keepalive.ClientParameters{
+	Time:                time.Minute,
+	Timeout:             20 * time.Second,
+	PermitWithoutStream: true,
+}
+
+// WorkerKeepalivePolicy is the keepalive enforcement policy of worker servers that accepts main server pings.
+var WorkerKeepalivePolicy = keepalive.EnforcementPolicy{
+	MinTime:             30 * time.Second,
+	PermitWithoutStream: true,
+}
+
+// workerServiceConfig enables gRPC health checking of worker connections.
+// Calls fail fast while worker reports it is not serving. Workers without health service are considered healthy.
+const workerServiceConfig = `{"loadBalancingConfig": [{"round_robin": {}}], "healthCheckConfig": {"serviceName": ""}}`
+
+// WorkerPool keeps one gRPC connection per worker node and reuses it between calls.
+type WorkerPool struct {
+	// CallTimeout is the deadline of worker calls.
+	CallTimeout time.Duration
+	// RunTimeout is the deadline of starting containers.
+	RunTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+// NewWorkerPool creates an empty connection pool with default timeouts.
+func NewWorkerPool() *WorkerPool {
+	return &WorkerPool{
+		CallTimeout: DefaultCallTimeout,
+		RunTimeout:  DefaultRunTimeout,
+		conns:       make(map[string]*grpc.ClientConn),
+	}
+}
+
+// client returns a client of worker at address, connecting to it if there is no connection in pool.
+func (p *WorkerPool) client(address string) (proto.WorkerClient, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if conn, ok := p.conns[address]; ok {
+		return proto.NewWorkerClient(conn), nil
+	}
+
+	// Dial is non-blocking, connection is established by the first call.
+	conn, err := grpc.Dial(address,
+		workerDialOption(),
+		grpc.WithKeepaliveParams(workerKeepalive),
+		grpc.WithDefaultServiceConfig(workerServiceConfig))
+	if err != nil {
+		return nil, err
+	}
+	p.conns[address] = conn
+	return proto.NewWorkerClient(conn), nil
+}
+
+// Invalidate closes the connection with worker at address.
+// Next call will connect again.
+func (p *WorkerPool) Invalidate(address string) {
+	p.mu.Lock()
+	conn, ok := p.conns[address]
+	delete(p.conns, address)
+	p.mu.Unlock()
+
+	if ok {
+		closeConn(address, conn)
+	}
+}
+
+// Close closes all connections.
+func (p *WorkerPool) Close() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = make(map[string]*grpc.ClientConn)
+	p.mu.Unlock()
+
+	for address, conn := range conns {
+		closeConn(address, conn)
+	}
+}
+
+// callContext returns a context with the call deadline.
+func (p *WorkerPool) callContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), p.CallTimeout)
+}
+
+func closeConn(address string, conn *grpc.ClientConn) {
+	if err := conn.Close(); err != nil {
+		log.WithError(err).WithField("address", address).Warn("Unable to close worker connection.")
+	}
+}
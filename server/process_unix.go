@@ -0,0 +1,476 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labbcb/rnnr/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// processPoll is how often process runtimes look for started and exited containers while watching.
+	processPoll = time.Second
+	// stopTimeout is the time processes have to exit after being asked to stop.
+	stopTimeout = 10 * time.Second
+)
+
+// processes tracks containers that are plain processes, for runtimes without a daemon.
+// Each container has a directory named after its task ID with process ID, standard output and error, and exit code.
+// Processes run in their own session, so they keep running and record their exit code if worker restarts.
+type processes struct {
+	dir string
+
+	// samples keeps the last CPU usage of running containers to compute CPU percentage between checks.
+	samples sync.Map
+}
+
+// processSample is the CPU time of a container at some point.
+type processSample struct {
+	cpuTime uint64
+	at      time.Time
+}
+
+func newProcesses(dir string) (*processes, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &processes{dir: dir}, nil
+}
+
+func (p *processes) path(id string, name ...string) string {
+	return filepath.Join(append([]string{p.dir, filepath.Base(id)}, name...)...)
+}
+
+// processSpec describes the process of a container.
+type processSpec struct {
+	command []string
+	workDir string
+	env     []string
+	// stdin, stdout and stderr are files redirected to the command, optional.
+	// Standard output and error go to container logs otherwise.
+	stdin, stdout, stderr string
+	// cgroup is the cgroup v2 directory the command runs in, optional.
+	cgroup string
+}
+
+// start starts the process of container id.
+// A shell waits for the command and records its exit code.
+// TERM and INT are trapped, not ignored, so that the command still receives them when stopping.
+func (p *processes) start(id string, spec processSpec) error {
+	if err := os.Mkdir(p.path(id), 0700); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("container %s already exists", id)
+		}
+		return err
+	}
+
+	run := `"$@"`
+	if spec.stdin != "" {
+		run += " < " + shellQuote(spec.stdin)
+	}
+	if spec.stdout != "" {
+		run += " > " + shellQuote(spec.stdout)
+	}
+	if spec.stderr != "" {
+		run += " 2> " + shellQuote(spec.stderr)
+	}
+	if spec.cgroup != "" {
+		// Shell joins the cgroup before starting the command, so all its processes are limited.
+		run = fmt.Sprintf("echo $$ > %s && %s", shellQuote(filepath.Join(spec.cgroup, "cgroup.procs")), run)
+	}
+	exit := shellQuote(p.path(id, "exit"))
+	script := fmt.Sprintf(`trap : TERM INT; { %s; }; echo $? > %s.tmp && mv %s.tmp %s`, run, exit, exit, exit)
+	cmd := exec.Command("/bin/sh", append([]string{"-c", script, "sh"}, spec.command...)...)
+	cmd.Dir = spec.workDir
+	cmd.Env = spec.env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	stdout, err := os.Create(p.path(id, "stdout"))
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+	stderr, err := os.Create(p.path(id, "stderr"))
+	if err != nil {
+		return err
+	}
+	defer stderr.Close()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Reap the shell while worker is running.
+	go func() {
+		_ = cmd.Wait()
+	}()
+	return ioutil.WriteFile(p.path(id, "pid"), []byte(strconv.Itoa(cmd.Process.Pid)), 0600)
+}
+
+// pid returns the process ID of container shell, which is also its session ID.
+// It returns zero if container is starting.
+func (p *processes) pid(id string) (int, error) {
+	b, err := ioutil.ReadFile(p.path(id, "pid"))
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(p.path(id)); os.IsNotExist(err) {
+			return 0, &ContainerNotFound{fmt.Errorf("container %s not found", id)}
+		}
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// exitCode returns the exit code of container if it exited.
+// Containers killed before recording their exit code exit with -1.
+func (p *processes) exitCode(id string, pid int) (code int, end time.Time, exited bool) {
+	file := p.path(id, "exit")
+	if b, err := ioutil.ReadFile(file); err == nil {
+		info, _ := os.Stat(file)
+		code, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+		return code, info.ModTime(), true
+	}
+	if pid != 0 && !alive(pid) {
+		return -1, time.Now(), true
+	}
+	return 0, time.Time{}, false
+}
+
+// Check returns the state of a container, including usage if it is running.
+func (p *processes) Check(_ context.Context, container *proto.Container) (*proto.State, error) {
+	pid, err := p.pid(container.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if code, end, exited := p.exitCode(container.Id, pid); exited {
+		state := &proto.State{Exited: true, ExitCode: int32(code), End: timestamppb.New(end)}
+		if info, err := os.Stat(p.path(container.Id, "pid")); err == nil {
+			state.Start = timestamppb.New(info.ModTime())
+		}
+		return state, nil
+	}
+
+	state := &proto.State{}
+	if pid != 0 {
+		state.CpuPercent, state.CpuTime, state.Memory = p.usage(container.Id, pid)
+	}
+	return state, nil
+}
+
+// CheckAll returns the states of containers, or of all containers if ids is empty.
+func (p *processes) CheckAll(ctx context.Context, ids []string) (map[string]*proto.State, error) {
+	if len(ids) == 0 {
+		var err error
+		if ids, err = p.list(); err != nil {
+			return nil, err
+		}
+	}
+
+	states := make(map[string]*proto.State)
+	for _, id := range ids {
+		state, err := p.Check(ctx, &proto.Container{Id: id})
+		if _, ok := err.(*ContainerNotFound); ok {
+			continue
+		}
+		if err != nil {
+			log.WithError(err).WithField("id", id).Warn("Unable to check container.")
+			continue
+		}
+		states[id] = state
+	}
+	return states, nil
+}
+
+func (p *processes) list() ([]string, error) {
+	infos, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, info := range infos {
+		if info.IsDir() {
+			ids = append(ids, info.Name())
+		}
+	}
+	return ids, nil
+}
+
+// Managed returns all containers by task ID.
+func (p *processes) Managed(context.Context) (map[string]*ContainerSummary, error) {
+	ids, err := p.list()
+	if err != nil {
+		return nil, err
+	}
+
+	managed := make(map[string]*ContainerSummary)
+	for _, id := range ids {
+		// Directory is modified when container exits, pid file is not.
+		info, err := os.Stat(p.path(id, "pid"))
+		if os.IsNotExist(err) {
+			info, err = os.Stat(p.path(id))
+		}
+		if err != nil {
+			continue
+		}
+		pid, err := p.pid(id)
+		if err != nil {
+			continue
+		}
+		_, _, exited := p.exitCode(id, pid)
+		managed[id] = &ContainerSummary{Running: !exited, Created: info.ModTime()}
+	}
+	return managed, nil
+}
+
+// Watch polls containers for start and exit events until ctx is canceled.
+// Usage of running containers is sampled every interval.
+func (p *processes) Watch(ctx context.Context, interval time.Duration, subscribed func() error, send func(*proto.Event) error) error {
+	if err := subscribed(); err != nil {
+		return err
+	}
+
+	running := make(map[string]bool)
+	if managed, err := p.Managed(ctx); err == nil {
+		for id, c := range managed {
+			running[id] = c.Running
+		}
+	}
+
+	poll := time.NewTicker(processPoll)
+	defer poll.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-poll.C:
+			managed, err := p.Managed(ctx)
+			if err != nil {
+				log.WithError(err).Warn("Unable to list containers.")
+				continue
+			}
+			for id, c := range managed {
+				var e *proto.Event
+				switch {
+				case c.Running && !running[id]:
+					e = &proto.Event{Type: proto.Event_START, Id: id}
+				case !c.Running && running[id]:
+					state, err := p.Check(ctx, &proto.Container{Id: id})
+					if err != nil {
+						continue
+					}
+					e = &proto.Event{Type: proto.Event_EXIT, Id: id, State: state}
+				}
+				running[id] = c.Running
+				if e == nil {
+					continue
+				}
+				e.Time = timestamppb.Now()
+				if err := send(e); err != nil {
+					return err
+				}
+			}
+			for id := range running {
+				if _, ok := managed[id]; !ok {
+					delete(running, id)
+				}
+			}
+		case <-ticker.C:
+			states, err := p.CheckAll(ctx, nil)
+			if err != nil {
+				log.WithError(err).Warn("Unable to sample container usage.")
+				continue
+			}
+			now := timestamppb.Now()
+			for id, state := range states {
+				if state.Exited {
+					continue
+				}
+				if err := send(&proto.Event{Type: proto.Event_USAGE, Id: id, Time: now, State: state}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// Logs copies container standard output and error to stdout and stderr writers.
+// A nil writer skips that output.
+// If follow is true it keeps copying until container exits or ctx is canceled.
+// tail is the number of lines from the end of each output, all lines if zero or negative.
+func (p *processes) Logs(ctx context.Context, id string, follow bool, tail int32, stdout, stderr io.Writer) error {
+	if _, err := p.pid(id); err != nil {
+		return err
+	}
+
+	type output struct {
+		file *os.File
+		w    io.Writer
+	}
+	var outputs []output
+	for name, w := range map[string]io.Writer{"stdout": stdout, "stderr": stderr} {
+		if w == nil {
+			continue
+		}
+		f, err := os.Open(p.path(id, name))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := seekTail(f, int(tail)); err != nil {
+			return err
+		}
+		outputs = append(outputs, output{f, w})
+	}
+
+	for {
+		// Exit is checked before copying so that the last output is copied.
+		pid, _ := p.pid(id)
+		_, _, exited := p.exitCode(id, pid)
+		for _, o := range outputs {
+			if _, err := io.Copy(o.w, o.file); err != nil {
+				return err
+			}
+		}
+		if !follow || exited {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(logsPollInterval):
+		}
+	}
+}
+
+// Stop asks container processes to exit, killing them after stopTimeout.
+func (p *processes) Stop(ctx context.Context, id string) error {
+	pid, err := p.pid(id)
+	if err != nil || pid == 0 || !alive(pid) {
+		return err
+	}
+
+	if err := syscall.Kill(-pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+	deadline := time.After(stopTimeout)
+	for alive(pid) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return syscall.Kill(-pid, syscall.SIGKILL)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// RemoveContainer kills container processes and removes its directory.
+func (p *processes) RemoveContainer(_ context.Context, id string) {
+	p.samples.Delete(id)
+	if pid, err := p.pid(id); err == nil && pid != 0 && alive(pid) {
+		if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil {
+			log.WithError(err).WithField("id", id).Warn("Unable to kill container.")
+		}
+	}
+	if err := os.RemoveAll(p.path(id)); err != nil {
+		log.WithError(err).Warn("Unable to remove container.")
+	} else {
+		log.WithField("id", id).Info("Container removed.")
+	}
+}
+
+// usage returns CPU and memory usage of container processes.
+// CPU percentage is relative to the previous sample.
+func (p *processes) usage(id string, pid int) (cpuPercent float64, cpuTime, memory uint64) {
+	cpuTime, memory, err := sessionUsage(pid)
+	if err != nil {
+		log.WithError(err).WithField("id", id).Warn("Unable to get container usage.")
+		return
+	}
+
+	sample := processSample{cpuTime, time.Now()}
+	if v, ok := p.samples.Load(id); ok {
+		prev := v.(processSample)
+		if elapsed := sample.at.Sub(prev.at); elapsed > 0 && sample.cpuTime >= prev.cpuTime {
+			cpuPercent = float64(sample.cpuTime-prev.cpuTime) / float64(elapsed.Nanoseconds()) * 100.0
+		}
+	}
+	p.samples.Store(id, sample)
+	return cpuPercent, cpuTime, memory
+}
+
+// alive returns true if process exists.
+func alive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// seekTail moves to the start of the last n lines of f, or does nothing if n is zero or negative.
+func seekTail(f *os.File, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 32*1024)
+	offset := end
+	// A trailing newline does not start a line.
+	skip := true
+	for offset > 0 {
+		size := int64(len(buf))
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		if _, err := f.ReadAt(buf[:size], offset); err != nil {
+			return err
+		}
+		for i := size - 1; i >= 0; i-- {
+			if buf[i] != '\n' {
+				skip = false
+				continue
+			}
+			if skip {
+				skip = false
+				continue
+			}
+			n--
+			if n == 0 {
+				_, err := f.Seek(offset+i+1, io.SeekStart)
+				return err
+			}
+		}
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+// shellQuote quotes s for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// PullPolicy defines when images are pulled before running containers.
+type PullPolicy string
+
+const (
+	// PullAlways pulls images before every run, getting new versions of tags.
+	PullAlways PullPolicy = "always"
+	// PullIfNotPresent pulls images that are not on the node.
+	PullIfNotPresent PullPolicy = "if-not-present"
+	// PullNever never pulls images, they must be on the node.
+	PullNever PullPolicy = "never"
+)
+
+// PullPolicies lists valid pull policies.
+var PullPolicies = []PullPolicy{PullAlways, PullIfNotPresent, PullNever}
+
+// ParsePullPolicy returns the pull policy named s.
+func ParsePullPolicy(s string) (PullPolicy, error) {
+	for _, p := range PullPolicies {
+		if PullPolicy(s) == p {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("invalid pull policy %q, valid policies are %v", s, PullPolicies)
+}
+
+// repoDigest returns the digest reference of image, like ubuntu@sha256:..., among the repository digests of a pulled image.
+// Images referenced by digest are returned as they are.
+// It returns an empty string if image was not pulled from its repository, for example images built on the node.
+func repoDigest(image string, digests []string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return ""
+	}
+	if _, ok := named.(reference.Canonical); ok {
+		return image
+	}
+	for _, d := range digests {
+		if r, err := reference.ParseNormalizedNamed(d); err == nil && r.Name() == named.Name() {
+			return reference.FamiliarString(r)
+		}
+	}
+	return ""
+}
+
+// dockerHub is the registry of images without a registry domain.
+const dockerHub = "docker.io"
+
+// RegistryAuths has private registry credentials by registry domain, read from a Docker config file.
+type RegistryAuths struct {
+	Auths map[string]types.AuthConfig `json:"auths"`
+	// CredsStore and CredHelpers name docker-credential helpers that keep credentials.
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// DefaultRegistryConfig returns the Docker config file of the current user.
+func DefaultRegistryConfig() string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".docker")
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+// LoadRegistryAuths reads registry credentials from a Docker config file.
+// It returns no credentials if file does not exist.
+func LoadRegistryAuths(file string) (*RegistryAuths, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return &RegistryAuths{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config RegistryAuths
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("invalid registry config %s: %w", file, err)
+	}
+	// Keys may be URLs like https://index.docker.io/v1/.
+	auths := make(map[string]types.AuthConfig)
+	for key, auth := range config.Auths {
+		auths[registryDomain(key)] = auth
+	}
+	config.Auths = auths
+	return &config, nil
+}
+
+// lookup returns the credentials of image registry, or an empty config if there are none.
+func (r *RegistryAuths) lookup(image string) (types.AuthConfig, error) {
+	var auth types.AuthConfig
+	if r == nil {
+		return auth, nil
+	}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return auth, err
+	}
+	domain := reference.Domain(named)
+
+	auth, ok := r.Auths[domain]
+	if ok && auth.Auth != "" && auth.Username == "" {
+		b, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return auth, fmt.Errorf("invalid credentials of registry %s: %w", domain, err)
+		}
+		userPassword := strings.SplitN(string(b), ":", 2)
+		if len(userPassword) != 2 {
+			return auth, fmt.Errorf("invalid credentials of registry %s", domain)
+		}
+		auth.Username, auth.Password = userPassword[0], userPassword[1]
+	}
+	if ok && (auth.Username != "" || auth.IdentityToken != "") {
+		auth.ServerAddress = domain
+		return auth, nil
+	}
+
+	helper := r.CredHelpers[domain]
+	if helper == "" {
+		helper = r.CredsStore
+	}
+	if helper == "" {
+		return types.AuthConfig{}, nil
+	}
+	return credentialHelper(helper, domain)
+}
+
+// encoded returns the credentials of image registry encoded for Docker API, or an empty string if there are none.
+func (r *RegistryAuths) encoded(image string) (string, error) {
+	auth, err := r.lookup(image)
+	if err != nil || auth == (types.AuthConfig{}) {
+		return "", err
+	}
+	b, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// credentialHelper gets registry credentials from docker-credential-<helper>.
+func credentialHelper(helper, domain string) (types.AuthConfig, error) {
+	server := domain
+	if domain == dockerHub {
+		server = "https://index.docker.io/v1/"
+	}
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	out, err := cmd.Output()
+	if err != nil {
+		// Helpers fail when they have no credentials for the registry.
+		if bytes.Contains(out, []byte("credentials not found")) {
+			return types.AuthConfig{}, nil
+		}
+		return types.AuthConfig{}, fmt.Errorf("credential helper %s failed for registry %s: %w", helper, domain, err)
+	}
+
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return types.AuthConfig{}, err
+	}
+	auth := types.AuthConfig{ServerAddress: domain}
+	// Helpers return identity tokens with <token> as user name.
+	if creds.Username == "<token>" {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username, auth.Password = creds.Username, creds.Secret
+	}
+	return auth, nil
+}
+
+// registryDomain returns the domain of a registry URL or host.
+func registryDomain(s string) string {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "https://"), "http://")
+	s = strings.SplitN(s, "/", 2)[0]
+	switch s {
+	case "index.docker.io", "registry-1.docker.io":
+		return dockerHub
+	}
+	return s
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+const testDigest = "sha256:26c68657ccce2cb0a31b330cb0be2b5e108d467f641c62e13ab40cbec258c68d"
+
+func TestRepoDigest(t *testing.T) {
+	tests := []struct {
+		name    string
+		image   string
+		digests []string
+		want    string
+	}{
+		{
+			name:    "Docker Hub tag",
+			image:   "ubuntu:22.04",
+			digests: []string{"ubuntu@" + testDigest},
+			want:    "ubuntu@" + testDigest,
+		},
+		{
+			name:    "Docker Hub image without tag",
+			image:   "ubuntu",
+			digests: []string{"docker.io/library/ubuntu@" + testDigest},
+			want:    "ubuntu@" + testDigest,
+		},
+		{
+			name:    "digest of same repository among others",
+			image:   "ghcr.io/labbcb/tool:1.0",
+			digests: []string{"labbcb/tool@sha256:0000000000000000000000000000000000000000000000000000000000000000", "ghcr.io/labbcb/tool@" + testDigest},
+			want:    "ghcr.io/labbcb/tool@" + testDigest,
+		},
+		{
+			name:  "image referenced by digest",
+			image: "ubuntu@" + testDigest,
+			want:  "ubuntu@" + testDigest,
+		},
+		{
+			name:  "image built on node",
+			image: "local/tool:dev",
+		},
+		{
+			name:    "digests of other repositories",
+			image:   "ubuntu:22.04",
+			digests: []string{"debian@" + testDigest},
+		},
+		{
+			name:  "invalid image",
+			image: "Ubuntu:22.04",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := repoDigest(tt.image, tt.digests); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryDomain(t *testing.T) {
+	tests := map[string]string{
+		"https://index.docker.io/v1/": dockerHub,
+		"registry-1.docker.io":        dockerHub,
+		"ghcr.io":                     "ghcr.io",
+		"http://registry.local:5000/": "registry.local:5000",
+	}
+	for key, want := range tests {
+		if got := registryDomain(key); got != want {
+			t.Errorf("registryDomain(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestRegistryAuthsLookup(t *testing.T) {
+	encoded := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	file := writeFile(t, `{"auths": {
+		"https://index.docker.io/v1/": {"auth": "`+encoded("alice:s3cr3t")+`"},
+		"ghcr.io": {"username": "bob", "password": "t0k3n"},
+		"registry.local:5000": {"identitytoken": "refresh"},
+		"broken.example": {"auth": "`+encoded("alice")+`"},
+		"empty.example": {}
+	}}`)
+	auths, err := LoadRegistryAuths(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		image string
+		want  types.AuthConfig
+		fail  bool
+	}{
+		{image: "ubuntu", want: types.AuthConfig{Auth: encoded("alice:s3cr3t"), Username: "alice", Password: "s3cr3t", ServerAddress: dockerHub}},
+		{image: "docker.io/labbcb/tool:1.0", want: types.AuthConfig{Auth: encoded("alice:s3cr3t"), Username: "alice", Password: "s3cr3t", ServerAddress: dockerHub}},
+		{image: "ghcr.io/labbcb/tool:1.0", want: types.AuthConfig{Username: "bob", Password: "t0k3n", ServerAddress: "ghcr.io"}},
+		{image: "registry.local:5000/tool", want: types.AuthConfig{IdentityToken: "refresh", ServerAddress: "registry.local:5000"}},
+		{image: "quay.io/biocontainers/samtools:1.15"},
+		{image: "empty.example/tool"},
+		{image: "broken.example/tool", fail: true},
+		{image: "Invalid:Image", fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			got, err := auths.lookup(tt.image)
+			if tt.fail {
+				if err == nil {
+					t.Errorf("got %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRegistryAuthsMissing(t *testing.T) {
+	auths, err := LoadRegistryAuths(t.TempDir() + "/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := auths.encoded("ubuntu"); err != nil || got != "" {
+		t.Errorf("got %q %v, want no credentials", got, err)
+	}
+	if _, err := LoadRegistryAuths(writeFile(t, "{")); err == nil {
+		t.Error("got no error loading invalid config")
+	}
+}
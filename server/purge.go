@@ -0,0 +1,134 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/labbcb/rnnr/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// purgeBatchSize is the maximum number of tasks loaded in memory while purging.
+const purgeBatchSize = 500
+
+// StartTaskPurger periodically removes terminated tasks that ended more than retention ago.
+// It will check for expired tasks every interval.
+func (m *Main) StartTaskPurger(retention, interval time.Duration) {
+	for {
+		n, err := m.PurgeTasks(time.Now().Add(-retention), models.TerminatedStates())
+		if err != nil {
+			log.WithError(err).Warn("Unable to purge tasks.")
+		} else if n > 0 {
+			log.WithField("tasks", n).Info("Expired tasks purged.")
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// PurgeTasks removes tasks in given states that ended before given time returning the number of deleted tasks.
+// Only terminated states are allowed.
+// If Main.ArchiveDir is set tasks are written to a compressed JSON Lines file before being deleted.
+func (m *Main) PurgeTasks(before time.Time, states []models.State) (int64, error) {
+	if len(states) == 0 {
+		states = models.TerminatedStates()
+	}
+	for _, state := range states {
+		if !state.Terminated() {
+			return 0, fmt.Errorf("unable to purge tasks in %s state", state)
+		}
+	}
+
+	var archive *taskArchive
+	if m.ArchiveDir != "" {
+		var err error
+		if archive, err = newTaskArchive(m.ArchiveDir); err != nil {
+			return 0, fmt.Errorf("creating archive file: %w", err)
+		}
+		defer func() {
+			if err := archive.Close(); err != nil {
+				log.WithError(err).WithField("file", archive.name).Error("Unable to close archive file.")
+			}
+		}()
+	}
+
+	var deleted int64
+	for {
+		tasks, err := m.DB.ListTasksBefore(before, states, purgeBatchSize)
+		if err != nil {
+			return deleted, err
+		}
+		if len(tasks) == 0 {
+			return deleted, nil
+		}
+
+		if archive != nil {
+			if err := archive.Write(tasks); err != nil {
+				return deleted, fmt.Errorf("archiving tasks to %s: %w", archive.name, err)
+			}
+		}
+
+		ids := make([]string, len(tasks))
+		for i, task := range tasks {
+			ids[i] = task.ID
+		}
+		n, err := m.DB.DeleteTasks(ids)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+}
+
+// taskArchive writes tasks as JSON Lines to a gzip-compressed file.
+// The file is only created when the first task is written.
+type taskArchive struct {
+	name string
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+}
+
+func newTaskArchive(dir string) (*taskArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("tasks-%s.jsonl.gz", time.Now().Format("20060102T150405")))
+	return &taskArchive{name: name}, nil
+}
+
+// Write appends tasks to archive file.
+func (a *taskArchive) Write(tasks []*models.Task) error {
+	if a.file == nil {
+		f, err := os.OpenFile(a.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		a.file = f
+		a.gz = gzip.NewWriter(f)
+		a.enc = json.NewEncoder(a.gz)
+	}
+
+	for _, task := range tasks {
+		if err := a.enc.Encode(task); err != nil {
+			return err
+		}
+	}
+	// Flush so that archived tasks are written before they are deleted from database.
+	return a.gz.Flush()
+}
+
+// Close flushes and closes archive file.
+func (a *taskArchive) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	if err := a.gz.Close(); err != nil {
+		return err
+	}
+	return a.file.Close()
+}
@@ -2,79 +2,302 @@ package server
 
 import (
 	"context"
+	"errors"
+	"io"
+	"time"
 
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/labbcb/rnnr/models"
 	"github.com/labbcb/rnnr/proto"
 	log "github.com/sirupsen/logrus"
-	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // GetNodeResources gets node resource information.
-func GetNodeResources(node *models.Node) (*proto.Info, error) {
-	conn, err := grpc.Dial(node.Address(), grpc.WithInsecure())
+func (p *WorkerPool) GetNodeResources(node *models.Node) (*proto.Info, error) {
+	client, err := p.client(node.Address())
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.WithError(err).Fatal("Unable to close client connection.")
-		}
-	}()
 
-	info, err := proto.NewWorkerClient(conn).GetInfo(context.Background(), &empty.Empty{})
+	ctx, cancel := p.callContext()
+	defer cancel()
+	return client.GetInfo(ctx, &empty.Empty{})
+}
+
+// RemotePull pulls the image of a task on worker, calling progress with download progress.
+// It returns false if worker does not pull images apart from running containers.
+func (p *WorkerPool) RemotePull(task *models.Task, address string, progress func(*proto.PullProgress)) (bool, error) {
+	return p.RemotePullImage(address, task.Executors[0].Image, backendParameter(task.Resources, PullPolicyParameter), progress)
+}
+
+// RemotePullImage pulls an image on worker according to pull policy, or worker policy if empty.
+// It returns false if worker does not pull images apart from running containers.
+func (p *WorkerPool) RemotePullImage(address, image, policy string, progress func(*proto.PullProgress)) (bool, error) {
+	client, err := p.client(address)
 	if err != nil {
-		return nil, err
+		return false, &NetworkError{err}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.RunTimeout)
+	defer cancel()
+	stream, err := client.PullImage(ctx, &proto.PullRequest{Image: image, PullPolicy: policy})
+	if err != nil {
+		return false, remoteError(err)
+	}
+	for {
+		msg, err := stream.Recv()
+		switch {
+		case err == io.EOF:
+			return true, nil
+		case status.Code(err) == codes.Unimplemented:
+			return false, nil
+		case status.Code(err) == codes.Unavailable:
+			return false, &NetworkError{err}
+		case err != nil:
+			return false, errors.New(status.Convert(err).Message())
+		}
+		progress(msg)
 	}
-	return info, nil
 }
 
 // RemoteRun remotely runs a task as a container.
-func RemoteRun(task *models.Task, address string) error {
-	// create a connection with worker node
-	conn, err := grpc.Dial(address, grpc.WithInsecure())
+// If pulled is true the image was pulled with RemotePull and worker does not pull it again.
+// The container runs the pulled image digest if it is known, even if the image tag changed meanwhile,
+// and as the user in task log metadata if it is set.
+func (p *WorkerPool) RemoteRun(task *models.Task, address string, pulled bool) error {
+	client, err := p.client(address)
 	if err != nil {
 		return &NetworkError{err}
 	}
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.WithError(err).Fatal("Unable to close client connection.")
+
+	container := asContainer(task)
+	container.User = task.Logs[0].Metadata[UserMetadata]
+	if pulled {
+		container.PullPolicy = string(PullNever)
+		if digest := task.Logs[0].Metadata[ImageDigestMetadata]; digest != "" {
+			container.Image = digest
 		}
-	}()
+	}
 
 	// convert a task to a container and remotely runs it
-	_, err = proto.NewWorkerClient(conn).RunContainer(context.Background(), asContainer(task))
-	if status.Code(err) == codes.Unavailable {
+	ctx, cancel := context.WithTimeout(context.Background(), p.RunTimeout)
+	defer cancel()
+	_, err = client.RunContainer(ctx, container)
+	switch status.Code(err) {
+	case codes.Unavailable:
 		return &NetworkError{err}
+	case codes.AlreadyExists:
+		// A previous attempt started it, but its response was lost.
+		return nil
 	}
 	return err
 }
 
 // RemoteCheck checks remotely a task.
-func RemoteCheck(task *models.Task, address string) error {
-	conn, err := grpc.Dial(address, grpc.WithInsecure())
+func (p *WorkerPool) RemoteCheck(task *models.Task, address string) error {
+	client, err := p.client(address)
+	if err != nil {
+		return &NetworkError{err}
+	}
+
+	ctx, cancel := p.callContext()
+	defer cancel()
+	state, err := client.CheckContainer(ctx, asContainer(task))
+	if err != nil {
+		return remoteError(err)
+	}
+
+	updateTaskState(task, state)
+	return nil
+}
+
+// RemoteCheckAll checks remotely tasks of a node in a single call.
+// It returns the state of each task by its ID. Tasks without container are not included.
+func (p *WorkerPool) RemoteCheckAll(tasks []*models.Task, address string) (map[string]*proto.State, error) {
+	client, err := p.client(address)
+	if err != nil {
+		return nil, &NetworkError{err}
+	}
+
+	ids := make([]string, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.ID
+	}
+
+	ctx, cancel := p.callContext()
+	defer cancel()
+	states, err := client.CheckContainers(ctx, &proto.ContainerIds{Ids: ids})
+	if err != nil {
+		return nil, remoteError(err)
+	}
+	return states.States, nil
+}
+
+// RemoteReconcile removes containers of worker whose tasks are not in active task IDs.
+// listed is when active tasks were listed. It returns IDs of removed containers.
+func (p *WorkerPool) RemoteReconcile(address string, active []string, listed time.Time) ([]string, error) {
+	client, err := p.client(address)
+	if err != nil {
+		return nil, &NetworkError{err}
+	}
+
+	ctx, cancel := p.callContext()
+	defer cancel()
+	resp, err := client.Reconcile(ctx, &proto.ActiveTasks{Ids: active, Listed: timestamppb.New(listed)})
+	if err != nil {
+		return nil, remoteError(err)
+	}
+	return resp.Removed, nil
+}
+
+// RemoteImages lists images cached on worker.
+func (p *WorkerPool) RemoteImages(address string) ([]*proto.Image, error) {
+	client, err := p.client(address)
+	if err != nil {
+		return nil, &NetworkError{err}
+	}
+
+	ctx, cancel := p.callContext()
+	defer cancel()
+	resp, err := client.ListImages(ctx, &empty.Empty{})
+	if err != nil {
+		return nil, remoteError(err)
+	}
+	return resp.Images, nil
+}
+
+// RemotePrune removes unused images of worker according to request.
+func (p *WorkerPool) RemotePrune(address string, req *proto.PruneRequest) (*proto.Pruned, error) {
+	client, err := p.client(address)
+	if err != nil {
+		return nil, &NetworkError{err}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.RunTimeout)
+	defer cancel()
+	resp, err := client.PruneImages(ctx, req)
+	if err != nil {
+		return nil, remoteError(err)
+	}
+	return resp, nil
+}
+
+// Watch receives container events of a node until ctx is canceled or connection fails.
+// connected is called once worker is streaming events.
+func (p *WorkerPool) Watch(ctx context.Context, address string, connected func(), handle func(*proto.Event)) error {
+	client, err := p.client(address)
+	if err != nil {
+		return &NetworkError{err}
+	}
+
+	stream, err := client.WatchContainers(ctx, &empty.Empty{})
+	if err != nil {
+		return remoteError(err)
+	}
+	// Worker sends watchingHeader after subscribing to container events.
+	// Otherwise the stream has ended and Recv returns the error.
+	if md, err := stream.Header(); err != nil {
+		return remoteError(err)
+	} else if len(md.Get(watchingHeader)) > 0 {
+		connected()
+	}
+
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return remoteError(err)
+		}
+		handle(event)
+	}
+}
+
+// RemoteLogs copies container logs from worker to stdout and stderr writers.
+// It returns when all requested logs were copied or ctx is canceled.
+func (p *WorkerPool) RemoteLogs(ctx context.Context, address string, req *proto.LogsRequest, stdout, stderr io.Writer) error {
+	client, err := p.client(address)
 	if err != nil {
 		return &NetworkError{err}
 	}
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Fatal(err)
+
+	stream, err := client.StreamLogs(ctx, req)
+	if err != nil {
+		return remoteError(err)
+	}
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return remoteError(err)
 		}
-	}()
 
-	state, err := proto.NewWorkerClient(conn).CheckContainer(context.Background(), asContainer(task))
+		w := stdout
+		if chunk.Stream == proto.LogChunk_STDERR {
+			w = stderr
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return err
+		}
+	}
+}
+
+// RemoteExec executes a command in a task container with a TTY.
+// start has task ID, command and initial terminal size.
+// input is called to get the next input message until it returns an error.
+// output is called with terminal output and with the exit code when command exits.
+// It returns when command exits or ctx is canceled.
+func (p *WorkerPool) RemoteExec(ctx context.Context, address string, start *proto.ExecInput, input func() (*proto.ExecInput, error), output func(*proto.ExecOutput) error) error {
+	client, err := p.client(address)
+	if err != nil {
+		return &NetworkError{err}
+	}
+
+	stream, err := client.Exec(ctx)
 	if err != nil {
-		if status.Code(err) == codes.Unavailable {
-			return &NetworkError{err}
+		return remoteError(err)
+	}
+	if err := stream.Send(start); err != nil {
+		return remoteError(err)
+	}
+
+	go func() {
+		for {
+			in, err := input()
+			if err != nil {
+				if err := stream.CloseSend(); err != nil {
+					log.WithError(err).Debug("Unable to close exec input.")
+				}
+				return
+			}
+			if err := stream.Send(in); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		out, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return remoteError(err)
+		}
+		if err := output(out); err != nil {
+			return err
 		}
-		return err
 	}
+}
 
+// updateTaskState updates task with the state of its container.
+func updateTaskState(task *models.Task, state *proto.State) {
 	// task finished
 	if state.Exited {
-		if state.ExitCode == 0 {
+		if state.ExitCode == 0 || task.Executors[0].IgnoreError {
 			task.State = models.Complete
 		} else {
 			task.State = models.ExecutorError
@@ -91,30 +314,32 @@ func RemoteCheck(task *models.Task, address string) error {
 			task.Metrics.Memory = state.Memory
 		}
 	}
-	return nil
 }
 
 // RemoteCancel cancels remotely a task.
-func RemoteCancel(task *models.Task, node *models.Node) error {
-	conn, err := grpc.Dial(node.Address(), grpc.WithInsecure())
+func (p *WorkerPool) RemoteCancel(task *models.Task, node *models.Node) error {
+	client, err := p.client(node.Address())
 	if err != nil {
 		return &NetworkError{err}
 	}
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Fatal(err)
-		}
-	}()
 
-	_, err = proto.NewWorkerClient(conn).StopContainer(context.Background(), asContainer(task))
-	if status.Code(err) == codes.Unavailable {
+	ctx, cancel := p.callContext()
+	defer cancel()
+	_, err = client.StopContainer(ctx, asContainer(task))
+	return remoteError(err)
+}
+
+// remoteError wraps errors of unreachable or unresponsive workers as NetworkError.
+func remoteError(err error) error {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
 		return &NetworkError{err}
 	}
 	return err
 }
 
 func asContainer(t *models.Task) *proto.Container {
-	return &proto.Container{
+	c := &proto.Container{
 		Id:      t.ID,
 		Image:   t.Executors[0].Image,
 		Command: t.Executors[0].Command,
@@ -122,7 +347,22 @@ func asContainer(t *models.Task) *proto.Container {
 		Outputs: outputs(t.Outputs),
 		Inputs:  inputs(t.Inputs),
 		Env:     t.Executors[0].Env,
+		Labels: map[string]string{
+			nameLabel:  t.Name,
+			ownerLabel: t.Owner,
+		},
+		PullPolicy: backendParameter(t.Resources, PullPolicyParameter),
+		Stdin:      t.Executors[0].Stdin,
+		Stdout:     t.Executors[0].Stdout,
+		Stderr:     t.Executors[0].Stderr,
+	}
+	if t.Resources != nil {
+		c.CpuCores = t.Resources.CPUCores
+		c.RamGb = t.Resources.RAMGb
 	}
+	// Relaxations were validated when task was created.
+	c.Security, _ = taskSecurity(t.Resources)
+	return c
 }
 
 func outputs(os []*models.Output) []*proto.Volume {
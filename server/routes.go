@@ -1,28 +1,46 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labbcb/rnnr/models"
+	"github.com/labbcb/rnnr/proto"
 	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 // Register binds endpoints for node management
 func (m *Main) register() {
-	m.Router.HandleFunc("/v1/nodes", m.handleListNodes()).Methods(http.MethodGet)
-	m.Router.HandleFunc("/v1/nodes", m.handleEnableNode()).Methods(http.MethodPost)
-	m.Router.HandleFunc("/v1/nodes/{id}", m.handleGetNode()).Methods(http.MethodGet)
-	m.Router.HandleFunc("/v1/nodes/{id}:disable", m.handleDisableNode()).Methods(http.MethodPost)
-
-	m.Router.HandleFunc("/ga4gh/tes/v1/tasks", m.handleListTasks()).Methods(http.MethodGet)
-	m.Router.HandleFunc("/ga4gh/tes/v1/tasks", m.handleCreateTask()).Methods(http.MethodPost)
-	m.Router.HandleFunc("/ga4gh/tes/v1/tasks/{id}", m.handleGetTask()).Methods(http.MethodGet)
-	m.Router.HandleFunc("/ga4gh/tes/v1/tasks/{id}:cancel", m.handleCancelTask()).Methods(http.MethodPost)
+	m.Router.Use(m.authenticate)
+
+	m.Router.HandleFunc("/v1/nodes", m.requireRole(m.handleListNodes(), Admin, Operator, Viewer)).Methods(http.MethodGet)
+	m.Router.HandleFunc("/v1/nodes", m.requireRole(m.handleEnableNode(), Admin, Operator)).Methods(http.MethodPost)
+	m.Router.HandleFunc("/v1/nodes/{id}", m.requireRole(m.handleGetNode(), Admin, Operator, Viewer)).Methods(http.MethodGet)
+	m.Router.HandleFunc("/v1/nodes/{id}:disable", m.requireRole(m.handleDisableNode(), Admin, Operator)).Methods(http.MethodPost)
+
+	m.Router.HandleFunc("/v1/images", m.requireRole(m.handleListImages(), Admin, Operator, Viewer)).Methods(http.MethodGet)
+	m.Router.HandleFunc("/v1/images:pull", m.requireRole(m.handlePullImages(), Admin)).Methods(http.MethodPost)
+	m.Router.HandleFunc("/v1/images:prune", m.requireRole(m.handlePruneImages(), Admin)).Methods(http.MethodPost)
+
+	m.Router.HandleFunc("/v1/tasks:purge", m.requireRole(m.handlePurgeTasks(), Admin)).Methods(http.MethodPost)
+
+	m.Router.HandleFunc("/v1/tasks/{id}/logs", m.requireRole(m.handleTaskLogs(), Admin, Operator, Viewer, Submitter)).Methods(http.MethodGet)
+	m.Router.HandleFunc("/v1/tasks/{id}/exec", m.requireRole(m.handleExecTask(), Admin)).Methods(http.MethodGet)
+
+	m.Router.HandleFunc("/ga4gh/tes/v1/tasks", m.requireRole(m.handleListTasks(), Admin, Operator, Viewer, Submitter)).Methods(http.MethodGet)
+	m.Router.HandleFunc("/ga4gh/tes/v1/tasks", m.requireRole(m.handleCreateTask(), Admin, Operator, Submitter)).Methods(http.MethodPost)
+	m.Router.HandleFunc("/ga4gh/tes/v1/tasks/{id}", m.requireRole(m.handleGetTask(), Admin, Operator, Viewer, Submitter)).Methods(http.MethodGet)
+	m.Router.HandleFunc("/ga4gh/tes/v1/tasks/{id}:cancel", m.requireRole(m.handleCancelTask(), Admin, Operator, Submitter)).Methods(http.MethodPost)
 	m.Router.HandleFunc("/ga4gh/tes/v1/service-info", m.handleGetServiceInfo()).Methods(http.MethodGet)
 }
 
@@ -127,12 +145,23 @@ func (m *Main) handleCreateTask() http.HandlerFunc {
 			return
 		}
 
-		if err := m.CreateTask(&task); err != nil {
+		task.Owner = ""
+		if id := RequestIdentity(r); id != nil {
+			task.Owner = id.Name
+		}
+
+		switch err := m.CreateTask(&task).(type) {
+		case nil:
+		case *InvalidTask:
+			log.WithFields(log.Fields{"name": task.Name, "error": err}).Warn("Invalid task.")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		default:
 			log.WithFields(log.Fields{"id": task.ID, "name": task.Name, "error": err}).Error("Unable to create task.")
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		log.WithFields(log.Fields{"id": task.ID, "name": task.Name}).Info("Task created.")
+		log.WithFields(log.Fields{"id": task.ID, "name": task.Name, "owner": task.Owner}).Info("Task created.")
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
@@ -148,11 +177,15 @@ func (m *Main) handleGetTask() http.HandlerFunc {
 		id := mux.Vars(r)["id"]
 		v := r.URL.Query()
 
-		viewString := v.Get("view")
-		if viewString == "" {
-			viewString = "MINIMAL"
+		view, err := parseView(v.Get("view"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !m.authorizeTask(w, r, id, Admin, Operator, Viewer) {
+			return
 		}
-		view := models.View(strings.ToUpper(viewString))
 
 		task, err := m.GetTask(id, view)
 		if err != nil {
@@ -168,26 +201,54 @@ func (m *Main) handleGetTask() http.HandlerFunc {
 func (m *Main) handleListTasks() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		v := r.URL.Query()
-		namePrefix := v.Get("name_prefix")
+		pageToken := v.Get("page_token")
 		pageSize, _ := strconv.ParseInt(v.Get("page_size"), 10, 64)
-		pageToken, _ := strconv.ParseInt(v.Get("page_token"), 10, 64)
 
-		viewString := v.Get("view")
-		if viewString == "" {
-			viewString = "MINIMAL"
+		view, err := parseView(v.Get("view"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		view := models.View(strings.ToUpper(viewString))
 
-		var states []models.State
+		filter := &models.TaskFilter{
+			NamePrefix: v.Get("name_prefix"),
+			Nodes:      v["node"],
+		}
 		for _, state := range v["state"] {
-			states = append(states, models.State(state))
+			filter.States = append(filter.States, models.State(state))
 		}
 
-		nodes := v["node"]
+		// tag_value[i] is the value of tag_key[i]. Missing or empty values match any value.
+		tagValues := v["tag_value"]
+		for i, key := range v["tag_key"] {
+			// Keys are database field names, they must not address nested fields or operators.
+			if key == "" || strings.Contains(key, ".") || strings.HasPrefix(key, "$") {
+				http.Error(w, fmt.Sprintf("invalid tag key %q", key), http.StatusBadRequest)
+				return
+			}
+			if filter.Tags == nil {
+				filter.Tags = make(map[string]string)
+			}
+			if i < len(tagValues) {
+				filter.Tags[key] = tagValues[i]
+			} else {
+				filter.Tags[key] = ""
+			}
+		}
 
-		tasks, err := m.ListTasks(namePrefix, pageSize, pageToken, view, nodes, states)
-		if err != nil {
-			log.WithFields(log.Fields{"pageSize": pageSize, "pageToken": pageToken, "view": view, "error": err}).Fatal("Unable to get all tasks.")
+		// Submitters only see their own tasks.
+		if !m.allowed(r, Admin, Operator, Viewer) {
+			filter.Owner = RequestIdentity(r).Name
+		}
+
+		tasks, err := m.ListTasks(pageSize, pageToken, view, filter)
+		switch err.(type) {
+		case nil:
+		case *InvalidPageToken:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			log.WithFields(log.Fields{"pageSize": pageSize, "pageToken": pageToken, "view": view, "error": err}).Error("Unable to get all tasks.")
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -198,7 +259,16 @@ func (m *Main) handleListTasks() http.HandlerFunc {
 func (m *Main) handleCancelTask() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := mux.Vars(r)["id"]
-		if err := m.CancelTask(id); err != nil {
+		if !m.authorizeTask(w, r, id, Admin, Operator) {
+			return
+		}
+
+		switch err := m.CancelTask(id); err {
+		case nil:
+		case mongo.ErrNoDocuments:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		default:
 			log.WithFields(log.Fields{"id": id, "error": err}).Error("Unable to cancel task.")
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -209,12 +279,286 @@ func (m *Main) handleCancelTask() http.HandlerFunc {
 	}
 }
 
+func (m *Main) handleTaskLogs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		v := r.URL.Query()
+
+		follow := v.Get("follow") == "true"
+		var tail int
+		if s := v.Get("tail"); s != "" && s != "all" {
+			var err error
+			if tail, err = strconv.Atoi(s); err != nil {
+				http.Error(w, "invalid tail: "+s, http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Standard output and error are interleaved unless stream is defined.
+		fw := &flushWriter{w: w}
+		var stdout, stderr io.Writer = fw, fw
+		switch s := v.Get("stream"); s {
+		case "":
+		case "stdout":
+			stderr = nil
+		case "stderr":
+			stdout = nil
+		default:
+			http.Error(w, "invalid stream: "+s, http.StatusBadRequest)
+			return
+		}
+
+		if !m.authorizeTask(w, r, id, Admin, Operator, Viewer) {
+			return
+		}
+
+		task, err := m.GetTask(id, models.Full)
+		if err != nil {
+			log.WithFields(log.Fields{"id": id, "error": err}).Error("Unable to get task.")
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if err := m.TaskLogs(r.Context(), task, follow, tail, stdout, stderr); err != nil {
+			log.WithFields(log.Fields{"id": id, "error": err}).Error("Unable to get task logs.")
+			// Logs can not be interrupted with an error status once they are being written.
+			if !fw.written {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+		}
+	}
+}
+
+// flushWriter sends response data to client as soon as it is written.
+type flushWriter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.written = true
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// upgrader upgrades exec requests to WebSocket.
+// Browsers are only allowed to connect from the same origin.
+var upgrader = websocket.Upgrader{}
+
+func (m *Main) handleExecTask() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		v := r.URL.Query()
+
+		command := v["command"]
+		if len(command) == 0 {
+			http.Error(w, "command is required", http.StatusBadRequest)
+			return
+		}
+		width, _ := strconv.ParseUint(v.Get("width"), 10, 32)
+		height, _ := strconv.ParseUint(v.Get("height"), 10, 32)
+
+		task, err := m.GetTask(id, models.Basic)
+		if err != nil {
+			log.WithFields(log.Fields{"id": id, "error": err}).Error("Unable to get task.")
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if task.State != models.Running {
+			http.Error(w, fmt.Sprintf("task is %s, not running", task.State), http.StatusConflict)
+			return
+		}
+		node, err := m.DB.GetNode(task.Host)
+		if err != nil {
+			log.WithFields(log.Fields{"id": id, "host": task.Host, "error": err}).Error("Unable to get node.")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.WithFields(log.Fields{"id": id, "error": err}).Warn("Unable to upgrade to WebSocket.")
+			return
+		}
+		defer func() {
+			if err := conn.Close(); err != nil {
+				log.WithError(err).Debug("Unable to close WebSocket.")
+			}
+		}()
+
+		fields := log.Fields{"id": id, "host": task.Host, "command": command}
+		if identity := RequestIdentity(r); identity != nil {
+			fields["user"] = identity.Name
+		}
+		log.WithFields(fields).Info("Executing command in task container.")
+
+		// Session ends when client disconnects.
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		input := func() (*proto.ExecInput, error) {
+			for {
+				t, data, err := conn.ReadMessage()
+				if err != nil {
+					cancel()
+					return nil, err
+				}
+				switch t {
+				case websocket.BinaryMessage:
+					return &proto.ExecInput{Stdin: data}, nil
+				case websocket.TextMessage:
+					var msg models.ExecMessage
+					if err := json.Unmarshal(data, &msg); err != nil {
+						log.WithError(err).WithFields(fields).Warn("Invalid exec message.")
+						continue
+					}
+					return &proto.ExecInput{Width: msg.Width, Height: msg.Height}, nil
+				}
+			}
+		}
+		output := func(out *proto.ExecOutput) error {
+			if out.Exited {
+				return conn.WriteJSON(&models.ExecMessage{ExitCode: &out.ExitCode})
+			}
+			return conn.WriteMessage(websocket.BinaryMessage, out.Data)
+		}
+
+		start := &proto.ExecInput{Id: id, Command: command, Width: uint32(width), Height: uint32(height)}
+		code, reason := websocket.CloseNormalClosure, ""
+		if err := m.Workers.RemoteExec(ctx, node.Address(), start, input, output); err != nil && ctx.Err() == nil {
+			log.WithError(err).WithFields(fields).Error("Unable to execute command in task container.")
+			code, reason = websocket.CloseInternalServerErr, err.Error()
+			// Close reason must fit in a control frame.
+			if len(reason) > 120 {
+				reason = reason[:120]
+			}
+		}
+		log.WithFields(fields).Info("Exec session ended.")
+		_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	}
+}
+
+func (m *Main) handlePurgeTasks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.PurgeTasksRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.WithField("error", err).Error("Unable to decode JSON.")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Before.IsZero() || !req.Before.Before(time.Now()) {
+			http.Error(w, "before must be a time in the past", http.StatusBadRequest)
+			return
+		}
+		for _, state := range req.States {
+			if !state.Terminated() {
+				http.Error(w, fmt.Sprintf("unable to purge tasks in %s state", state), http.StatusBadRequest)
+				return
+			}
+		}
+
+		n, err := m.PurgeTasks(req.Before, req.States)
+		if err != nil {
+			log.WithFields(log.Fields{"before": req.Before, "states": req.States, "deleted": n, "error": err}).Error("Unable to purge tasks.")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.WithFields(log.Fields{"before": req.Before, "states": req.States, "deleted": n}).Info("Tasks purged.")
+		encodeJSON(w, &models.PurgeTasksResponse{Deleted: n})
+	}
+}
+
+func (m *Main) handleListImages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nodes := r.URL.Query()["node"]
+		images, err := m.ListImages(nodes)
+		if err != nil {
+			log.WithFields(log.Fields{"nodes": nodes, "error": err}).Error("Unable to list images.")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		encodeJSON(w, images)
+	}
+}
+
+func (m *Main) handlePullImages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.PullImagesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.WithField("error", err).Error("Unable to decode JSON.")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.Images) == 0 {
+			http.Error(w, "no image to pull", http.StatusBadRequest)
+			return
+		}
+		if req.PullPolicy != "" {
+			if _, err := ParsePullPolicy(req.PullPolicy); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		res, err := m.PullImages(&req)
+		if err != nil {
+			log.WithFields(log.Fields{"images": req.Images, "nodes": req.Nodes, "error": err}).Error("Unable to pull images.")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		encodeJSON(w, res)
+	}
+}
+
+func (m *Main) handlePruneImages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req models.PruneImagesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.WithField("error", err).Error("Unable to decode JSON.")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.MaxSize <= 0 && req.UnusedSeconds <= 0 {
+			http.Error(w, "max_size or unused_seconds is required", http.StatusBadRequest)
+			return
+		}
+
+		res, err := m.PruneImages(&req)
+		if err != nil {
+			log.WithFields(log.Fields{"nodes": req.Nodes, "error": err}).Error("Unable to prune images.")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		encodeJSON(w, res)
+	}
+}
+
 func (m *Main) handleGetServiceInfo() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		encodeJSON(w, m.ServiceInfo)
 	}
 }
 
+// parseView parses task view query parameter (case insensitive). Default view is Minimal.
+func parseView(s string) (models.View, error) {
+	if s == "" {
+		return models.Minimal, nil
+	}
+	switch view := models.View(strings.ToUpper(s)); view {
+	case models.Minimal, models.Basic, models.Full:
+		return view, nil
+	default:
+		return "", fmt.Errorf("invalid view %q: use MINIMAL, BASIC or FULL", s)
+	}
+}
+
 func encodeJSON(w http.ResponseWriter, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(v); err != nil {
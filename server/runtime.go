@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/labbcb/rnnr/proto"
+)
+
+const (
+	// taskLabel identifies containers managed by RNNR. Its value is the task ID.
+	taskLabel = "org.labbcb.rnnr.task"
+	// nameLabel and ownerLabel help finding task containers with runtime tools.
+	nameLabel  = "org.labbcb.rnnr.name"
+	ownerLabel = "org.labbcb.rnnr.owner"
+)
+
+// Runtime runs task containers of a worker.
+// Containers are named after task IDs.
+// Methods return ContainerNotFound when a container does not exist.
+type Runtime interface {
+	// Pull pulls an image according to policy. Progress is reported if progress is not nil.
+	// It returns the repository digest of the image, like ubuntu@sha256:..., or an empty string if it is unknown.
+	Pull(ctx context.Context, image string, policy PullPolicy, progress func(*proto.PullProgress)) (string, error)
+	// Run pulls the image according to container pull policy and starts a container.
+	Run(ctx context.Context, container *proto.Container) error
+	// Check returns the state of a container, including usage if it is running.
+	Check(ctx context.Context, container *proto.Container) (*proto.State, error)
+	// CheckAll returns the states of containers, or of all containers managed by RNNR if ids is empty.
+	// Containers that do not exist are not included.
+	CheckAll(ctx context.Context, ids []string) (map[string]*proto.State, error)
+	// Managed returns containers managed by RNNR by task ID.
+	Managed(ctx context.Context) (map[string]*ContainerSummary, error)
+	// Watch sends container events until ctx is canceled, and usage of running containers every interval.
+	// subscribed is called once events are being received.
+	Watch(ctx context.Context, interval time.Duration, subscribed func() error, send func(*proto.Event) error) error
+	// Logs copies container standard output and error. A nil writer skips that output.
+	Logs(ctx context.Context, id string, follow bool, tail int32, stdout, stderr io.Writer) error
+	// Exec executes a command with a TTY in a running container.
+	Exec(ctx context.Context, id string, command []string, width, height uint) (ExecSession, error)
+	// Stop stops a container.
+	Stop(ctx context.Context, id string) error
+	// RemoveContainer removes a container, logging failures.
+	RemoveContainer(ctx context.Context, id string)
+}
+
+// ImageCache is implemented by runtimes that keep pulled images on the node.
+type ImageCache interface {
+	// Images lists images on the node with ID, references, size and whether containers use them.
+	Images(ctx context.Context) ([]*proto.Image, error)
+	// RemoveImage removes an image by ID.
+	RemoveImage(ctx context.Context, id string) error
+}
+
+// ContainerSummary describes a container managed by RNNR.
+type ContainerSummary struct {
+	Running bool
+	Created time.Time
+}
+
+// ExecSession is a command executed with a TTY in a running container.
+// Reads return terminal output and writes go to terminal input.
+type ExecSession interface {
+	io.ReadWriter
+	// Resize resizes terminal if width and height are not zero.
+	Resize(ctx context.Context, width, height uint) error
+	// CloseInput closes terminal input.
+	CloseInput() error
+	// Close closes the connection with command.
+	// The command keeps running if it has not exited.
+	Close()
+	// ExitCode returns the exit code of the command, or -1 if it is still running.
+	ExitCode(ctx context.Context) (int, error)
+}
+
+// Runtimes lists the names of supported container runtimes.
+var Runtimes = []string{"docker", "podman", "apptainer", "local"}
+
+// RuntimeOptions configures container runtimes.
+type RuntimeOptions struct {
+	// Dir keeps containers of runtimes without a daemon.
+	Dir string
+	// Volumes are mounted in all containers.
+	Volumes []string
+	// User and Group run containers if runtime supports it.
+	User, Group string
+	// Registries has credentials to pull images.
+	Registries *RegistryAuths
+	// Security hardens containers.
+	Security SecurityProfile
+}
+
+// NewRuntime connects to a container runtime by name.
+func NewRuntime(name string, opts RuntimeOptions) (Runtime, error) {
+	switch name {
+	case "docker":
+		d, err := DockerConnect(opts.Volumes, opts.User, opts.Group)
+		if err != nil {
+			return nil, err
+		}
+		return d, d.configure(opts)
+	case "podman":
+		p, err := PodmanConnect(opts.Volumes, opts.User, opts.Group)
+		if err != nil {
+			return nil, err
+		}
+		return p, p.configure(opts)
+	case "apptainer":
+		return ApptainerConnect(filepath.Join(opts.Dir, "apptainer"), opts.Volumes, opts.Registries, opts.Security)
+	case "local":
+		if opts.Security != (SecurityProfile{}) {
+			return nil, errors.New("local runtime cannot apply security profiles")
+		}
+		return LocalConnect(filepath.Join(opts.Dir, "local"))
+	default:
+		return nil, fmt.Errorf("unknown container runtime %q, supported runtimes are %v", name, Runtimes)
+	}
+}
@@ -20,7 +20,9 @@ type NoEnoughResources struct {
 // EnableNode inserts or enables a worker node.
 // Use the current computational resources of the node if it had not been defined.
 func (m *Main) EnableNode(node *models.Node) error {
-	info, err := GetNodeResources(node)
+	// Connect again in case node address or certificates changed.
+	m.Workers.Invalidate(node.Address())
+	info, err := m.Workers.GetNodeResources(node)
 	if err != nil {
 		return err
 	}
@@ -65,18 +67,21 @@ func (m *Main) DisableNode(host string, cancel bool) error {
 	}
 
 	if !cancel {
+		m.Workers.Invalidate(node.Address())
 		return nil
 	}
 
 	go func() {
-		tasks, err := m.DB.ListTasks(0, 0, models.Full, []string{host}, []models.State{models.Initializing, models.Running, models.Paused})
+		defer m.Workers.Invalidate(node.Address())
+
+		tasks, err := m.DB.ListTasks(0, nil, models.Full, &models.TaskFilter{Nodes: []string{host}, States: []models.State{models.Initializing, models.Running, models.Paused}})
 		if err != nil {
 			log.WithError(err).Warn("Unable to get tasks to cancel.")
 			return
 		}
 
 		for _, task := range tasks {
-			if err := RemoteCancel(task, node); err != nil {
+			if err := m.Workers.RemoteCancel(task, node); err != nil {
 				log.WithError(err).WithFields(log.Fields{"id": task.ID, "host": task.Host}).Warn("Unable to remotely cancel task.")
 			}
 
@@ -96,8 +101,9 @@ func (m *Main) ListNodes(active *bool) ([]*models.Node, error) {
 // RequestNode selects a node that have enough computing resource to execute task.
 // If there is no active node it returns NoActiveNodes error.
 // If there is some active node but none of them is able to process then it returns NoEnoughResources error.
+// Nodes that already have image are preferred.
 // Once found a node it will update in database.
-func (m *Main) RequestNode(resources *models.Resources) (*models.Node, error) {
+func (m *Main) RequestNode(resources *models.Resources, image string) (*models.Node, error) {
 	// GetTask active computing nodes.
 	active := true
 	nodes, err := m.DB.ListNodes(&active)
@@ -116,8 +122,10 @@ func (m *Main) RequestNode(resources *models.Resources) (*models.Node, error) {
 	// Get the best node for the requested computing resources.
 	// The selected node should have enough CPU and Memory available.
 	// Calculate how much free resources nodes would have if task is assigned.
-	// The node with least free resources available is selected.
+	// Among nodes that have the task image, or all nodes if none has it,
+	// the node with least free resources available is selected.
 	var bestNode *models.Node
+	var bestCached bool
 	for _, node := range nodes {
 		freeCPU := node.CPUCores - node.Usage.CPUCores - resources.CPUCores
 		freeRAMGb := node.RAMGb - node.Usage.RAMGb - resources.RAMGb
@@ -126,8 +134,10 @@ func (m *Main) RequestNode(resources *models.Resources) (*models.Node, error) {
 			continue
 		}
 
-		if bestNode == nil || freeCPU <= bestNode.CPUCores && freeRAMGb <= bestNode.RAMGb {
+		cached := m.images.has(node.Host, image)
+		if bestNode == nil || cached && !bestCached || cached == bestCached && freeCPU <= bestNode.CPUCores && freeRAMGb <= bestNode.RAMGb {
 			bestNode = node
+			bestCached = cached
 		}
 	}
 
@@ -141,7 +151,7 @@ func (m *Main) RequestNode(resources *models.Resources) (*models.Node, error) {
 // UpdateNodesWorkload gets active tasks (Initializing or Running) and update node usage.
 func (m *Main) UpdateNodesWorkload(nodes []*models.Node) error {
 	usage := make(map[string]*models.Usage)
-	tasks, err := m.DB.ListTasks(0, 0, models.Full, nil, []models.State{models.Initializing, models.Running})
+	tasks, err := m.DB.ListTasks(0, nil, models.Full, &models.TaskFilter{States: []models.State{models.Initializing, models.Running}})
 	if err != nil {
 		return err
 	}
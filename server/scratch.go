@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/labbcb/rnnr/proto"
+	log "github.com/sirupsen/logrus"
+)
+
+// ScratchPath is where containers find their scratch directory. TMPDIR points to it.
+const ScratchPath = "/scratch"
+
+// ScratchSpace creates a scratch directory for each container on a local disk of the worker.
+// Directories are named after container IDs and may be limited in size.
+type ScratchSpace struct {
+	// Dir keeps scratch directories.
+	Dir string
+	// KeepFailed is how long scratch directories of failed containers are kept for debugging, zero to remove them.
+	KeepFailed time.Duration
+
+	limit scratchLimit
+}
+
+// scratchLimit limits the size of scratch directories.
+type scratchLimit interface {
+	// apply limits dir, leaving it as it was if it fails.
+	apply(dir string) error
+	release(dir string) error
+}
+
+// NewScratchSpace creates scratch space in dir.
+// If size is greater than zero, each scratch directory is limited to size bytes
+// with an XFS project quota, if dir is on XFS with project quotas, or with a loop device.
+// Both require worker to run as root on Linux.
+func NewScratchSpace(dir string, size int64, keepFailed time.Duration) (*ScratchSpace, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Others may enter task directories but not list them.
+	if err := os.MkdirAll(dir, 0711); err != nil {
+		return nil, err
+	}
+	limit, err := newScratchLimit(dir, size)
+	if err != nil {
+		return nil, err
+	}
+	return &ScratchSpace{Dir: dir, KeepFailed: keepFailed, limit: limit}, nil
+}
+
+// Create creates the scratch directory of a container and returns its path.
+// Only the worker user may write to it, unless the container runs as user (UID:GID).
+// Then it is owned by user if worker runs as root, otherwise anyone may write to it like /tmp.
+// It fails without touching the directory if it already exists, since it may belong to a running container.
+func (s *ScratchSpace) Create(id, user string) (string, error) {
+	dir := s.path(id)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		if os.IsExist(err) {
+			return "", fmt.Errorf("scratch directory %s already exists", dir)
+		}
+		return "", err
+	}
+	if s.limit != nil {
+		if err := s.limit.apply(dir); err != nil {
+			// Limits undo their own changes when they fail.
+			os.Remove(dir)
+			return "", err
+		}
+	}
+
+	var err error
+	switch {
+	case user == "":
+		err = os.Chmod(dir, 0700)
+	case os.Geteuid() == 0:
+		var uid, gid int64
+		if uid, gid, err = parseUser(user); err == nil {
+			err = os.Chown(dir, int(uid), int(gid))
+		}
+	default:
+		err = os.Chmod(dir, 0777|os.ModeSticky)
+	}
+	if err != nil {
+		s.remove(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// Remove removes the scratch directory of a container.
+// Directories of failed containers are kept if KeepFailed is set.
+func (s *ScratchSpace) Remove(id string, failed bool) {
+	dir := s.path(id)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return
+	}
+	if failed && s.KeepFailed > 0 {
+		log.WithFields(log.Fields{"id": id, "dir": dir, "keep": s.KeepFailed}).Info("Keeping scratch directory of failed container.")
+		return
+	}
+	s.remove(dir)
+}
+
+// Clean removes scratch directories of containers not in ids that were modified before,
+// and at least KeepFailed ago, like directories kept after failures or left by a crashed worker.
+func (s *ScratchSpace) Clean(ids map[string]bool, before time.Time) {
+	if kept := time.Now().Add(-s.KeepFailed); kept.Before(before) {
+		before = kept
+	}
+	infos, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		log.WithError(err).Warn("Unable to list scratch directories.")
+		return
+	}
+	for _, info := range infos {
+		if !info.IsDir() || ids[info.Name()] || !info.ModTime().Before(before) {
+			continue
+		}
+		s.remove(filepath.Join(s.Dir, info.Name()))
+	}
+}
+
+// remove releases size limit of a scratch directory and removes it, logging failures.
+// Directories are kept if their limit cannot be released, because they may still be mounted.
+func (s *ScratchSpace) remove(dir string) {
+	if s.limit != nil {
+		if err := s.limit.release(dir); err != nil {
+			log.WithError(err).WithField("dir", dir).Warn("Unable to release scratch directory.")
+			return
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.WithError(err).WithField("dir", dir).Warn("Unable to remove scratch directory.")
+		return
+	}
+	log.WithField("dir", dir).Info("Scratch directory removed.")
+}
+
+func (s *ScratchSpace) path(id string) string {
+	return filepath.Join(s.Dir, filepath.Base(id))
+}
+
+// scratchEnv returns TMPDIR pointing to the scratch directory of container at path, unless task sets TMPDIR.
+func scratchEnv(container *proto.Container, path string) []string {
+	if _, ok := container.Env["TMPDIR"]; ok || container.Scratch == "" {
+		return nil
+	}
+	return []string{"TMPDIR=" + path}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newScratchLimit limits scratch directories in dir to size bytes, or does not limit them if size is not greater than zero.
+// XFS project quotas are preferred to loop devices, which take space even when tasks do not use it.
+func newScratchLimit(dir string, size int64) (scratchLimit, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+	if os.Geteuid() != 0 {
+		return nil, errors.New("scratch size limit requires worker to run as root")
+	}
+
+	if mountPoint, ok := xfsProjectQuota(dir); ok {
+		if _, err := exec.LookPath("xfs_quota"); err == nil {
+			log.WithFields(log.Fields{"dir": dir, "mount": mountPoint}).Info("Scratch directories are limited with XFS project quotas.")
+			return &xfsQuota{mountPoint: mountPoint, size: size}, nil
+		}
+	}
+	for _, name := range []string{"mkfs.ext4", "mount", "umount"} {
+		if _, err := exec.LookPath(name); err != nil {
+			return nil, fmt.Errorf("scratch size limit requires XFS with project quotas (prjquota) or %s to use loop devices", name)
+		}
+	}
+	log.WithField("dir", dir).Info("Scratch directories are limited with loop devices.")
+	return &loopDevice{size: size}, nil
+}
+
+// xfsProjectQuota returns the mount point of dir if it is on XFS mounted with project quotas.
+func xfsProjectQuota(dir string) (string, bool) {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", false
+	}
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	// Fields are ID, parent ID, device, root, mount point, options, optional fields, -, type, source and super options.
+	var mountPoint, fsType, options string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := 6
+		for sep < len(fields) && fields[sep] != "-" {
+			sep++
+		}
+		if sep+3 >= len(fields) {
+			continue
+		}
+		// Longest mount point containing dir is the last one mounted.
+		target := fields[4]
+		if (target == "/" || dir == target || strings.HasPrefix(dir, target+"/")) && len(target) >= len(mountPoint) {
+			mountPoint, fsType, options = target, fields[sep+1], fields[sep+3]
+		}
+	}
+	if fsType != "xfs" {
+		return "", false
+	}
+	for _, option := range strings.Split(options, ",") {
+		if option == "prjquota" || option == "pquota" {
+			return mountPoint, true
+		}
+	}
+	return "", false
+}
+
+// xfsQuota limits scratch directories with XFS project quotas.
+// Project IDs are derived from directory names.
+type xfsQuota struct {
+	mountPoint string
+	size       int64
+}
+
+func (q *xfsQuota) apply(dir string) error {
+	id := projectID(dir)
+	if err := q.run(fmt.Sprintf("project -s -p %s %d", dir, id)); err != nil {
+		return err
+	}
+	if err := q.run(fmt.Sprintf("limit -p bhard=%d %d", q.size, id)); err != nil {
+		q.release(dir)
+		return err
+	}
+	return nil
+}
+
+func (q *xfsQuota) release(dir string) error {
+	return q.run(fmt.Sprintf("limit -p bhard=0 %d", projectID(dir)))
+}
+
+func (q *xfsQuota) run(command string) error {
+	if out, err := exec.Command("xfs_quota", "-x", "-c", command, q.mountPoint).CombinedOutput(); err != nil {
+		return fmt.Errorf("xfs_quota %s: %v: %s", command, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// projectID returns an XFS project ID of a scratch directory, away from small IDs used by administrators.
+func projectID(dir string) uint32 {
+	return 1<<30 + crc32.ChecksumIEEE([]byte(filepath.Base(dir)))%(1<<30)
+}
+
+// loopDevice limits scratch directories by mounting an ext4 image file of limited size on them.
+// Image files are sparse and kept next to directories.
+type loopDevice struct {
+	size int64
+}
+
+func (l *loopDevice) apply(dir string) (err error) {
+	image := dir + ".img"
+	f, err := os.OpenFile(image, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	// Only the image created here is removed, nothing is mounted on dir if mount fails.
+	defer func() {
+		if err != nil {
+			os.Remove(image)
+		}
+	}()
+	err = f.Truncate(l.size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := runCommand("mkfs.ext4", "-q", "-F", "-m", "0", image); err != nil {
+		return err
+	}
+	return runCommand("mount", "-o", "loop", image, dir)
+}
+
+func (l *loopDevice) release(dir string) error {
+	image := dir + ".img"
+	if _, err := os.Stat(image); os.IsNotExist(err) {
+		return nil
+	}
+	if mounted(dir) {
+		if err := runCommand("umount", dir); err != nil {
+			return err
+		}
+	}
+	return os.Remove(image)
+}
+
+// mounted tells whether dir is a mount point.
+func mounted(dir string) bool {
+	b, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if fields := strings.Fields(line); len(fields) > 4 && fields[4] == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func runCommand(name string, args ...string) error {
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", name, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import "errors"
+
+// newScratchLimit fails if size is greater than zero, because quotas and loop devices require Linux.
+func newScratchLimit(_ string, size int64) (scratchLimit, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+	return nil, errors.New("scratch size limit requires Linux")
+}
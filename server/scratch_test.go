@@ -0,0 +1,70 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScratchSpaceCreate(t *testing.T) {
+	s, err := NewScratchSpace(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Root gives directories to task users, others let anyone write to them.
+	taskUserMode := 0777 | os.ModeSticky
+	if os.Geteuid() == 0 {
+		taskUserMode = 0700
+	}
+
+	tests := []struct {
+		id, user string
+		mode     os.FileMode
+	}{
+		{id: "worker-user", mode: 0700},
+		{id: "task-user", user: "1001:1001", mode: taskUserMode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			dir, err := s.Create(tt.id, tt.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := info.Mode() &^ os.ModeDir; mode != tt.mode {
+				t.Errorf("got mode %v, want %v", mode, tt.mode)
+			}
+		})
+	}
+}
+
+func TestScratchSpaceCreateExisting(t *testing.T) {
+	s, err := NewScratchSpace(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := s.Create("task", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "data")
+	if err := ioutil.WriteFile(file, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Create("task", ""); err == nil {
+		t.Error("got no error creating existing directory")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("existing directory was changed: %v", err)
+	}
+
+	s.Remove("task", false)
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("directory was not removed: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/labbcb/rnnr/models"
+	"github.com/labbcb/rnnr/proto"
+)
+
+// Backend parameters that relax the worker security profile of a task, if main server policy allows it.
+const (
+	// NetworkParameter set to true gives network access to tasks on workers that disable network.
+	NetworkParameter = "network"
+	// WritableRootfsParameter set to true keeps the root filesystem writable on workers that make it read-only.
+	WritableRootfsParameter = "writable_rootfs"
+	// CapabilitiesParameter has comma-separated capabilities kept on workers that drop all capabilities.
+	CapabilitiesParameter = "capabilities"
+)
+
+// SecurityProfile hardens task containers of a worker.
+type SecurityProfile struct {
+	// DropCapabilities drops all Linux capabilities.
+	DropCapabilities bool
+	// NoNewPrivileges prevents processes from gaining privileges, for example with setuid executables.
+	NoNewPrivileges bool
+	// ReadOnlyRootfs makes the root filesystem read-only, with a writable tmpfs at /tmp.
+	ReadOnlyRootfs bool
+	// Seccomp is a seccomp profile file, runtime default if empty.
+	Seccomp string
+	// AppArmor is the name of an AppArmor profile loaded on the node, runtime default if empty.
+	AppArmor string
+	// NetworkNone runs containers without network.
+	NetworkNone bool
+}
+
+// dockerSecurityOpt returns Docker security options of profile.
+// Docker API takes the content of seccomp profiles, not their file names.
+func (p SecurityProfile) dockerSecurityOpt() ([]string, error) {
+	var opts []string
+	if p.NoNewPrivileges {
+		opts = append(opts, "no-new-privileges")
+	}
+	if p.Seccomp != "" {
+		b, err := ioutil.ReadFile(p.Seccomp)
+		if err != nil {
+			return nil, fmt.Errorf("reading seccomp profile: %w", err)
+		}
+		opts = append(opts, "seccomp="+string(b))
+	}
+	if p.AppArmor != "" {
+		opts = append(opts, "apparmor="+p.AppArmor)
+	}
+	return opts, nil
+}
+
+// SecurityPolicy defines which relaxations of worker security profiles tasks may request with backend parameters.
+type SecurityPolicy struct {
+	// AllowNetwork allows tasks to request network access.
+	AllowNetwork bool
+	// AllowWritableRootfs allows tasks to request a writable root filesystem.
+	AllowWritableRootfs bool
+	// Capabilities lists capabilities tasks may request.
+	Capabilities []string
+}
+
+// Check returns an error if task requests relaxations not allowed by policy, or invalid ones.
+func (p *SecurityPolicy) Check(r *models.Resources) error {
+	s, err := taskSecurity(r)
+	if err != nil || s == nil {
+		return err
+	}
+	if s.Network && !p.AllowNetwork {
+		return fmt.Errorf("backend parameter %s is not allowed by server policy", NetworkParameter)
+	}
+	if s.WritableRootfs && !p.AllowWritableRootfs {
+		return fmt.Errorf("backend parameter %s is not allowed by server policy", WritableRootfsParameter)
+	}
+	for _, c := range s.Capabilities {
+		if !containsCapability(p.Capabilities, c) {
+			return fmt.Errorf("capability %s is not allowed by server policy", c)
+		}
+	}
+	return nil
+}
+
+// taskSecurity returns the relaxations requested by backend parameters of a task, or nil if there are none.
+func taskSecurity(r *models.Resources) (*proto.Security, error) {
+	s := &proto.Security{}
+	var err error
+	if v := backendParameter(r, NetworkParameter); v != "" {
+		if s.Network, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid backend parameter %s: %w", NetworkParameter, err)
+		}
+	}
+	if v := backendParameter(r, WritableRootfsParameter); v != "" {
+		if s.WritableRootfs, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid backend parameter %s: %w", WritableRootfsParameter, err)
+		}
+	}
+	for _, c := range strings.Split(backendParameter(r, CapabilitiesParameter), ",") {
+		if c = normalizeCapability(c); c != "" {
+			s.Capabilities = append(s.Capabilities, c)
+		}
+	}
+	if !s.Network && !s.WritableRootfs && len(s.Capabilities) == 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// normalizeCapability returns a capability name like Docker does, in upper case without CAP_ prefix.
+func normalizeCapability(c string) string {
+	return strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(c)), "CAP_")
+}
+
+func containsCapability(capabilities []string, c string) bool {
+	for _, allowed := range capabilities {
+		if normalizeCapability(allowed) == c {
+			return true
+		}
+	}
+	return false
+}
@@ -2,34 +2,121 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/labbcb/rnnr/models"
+	"github.com/labbcb/rnnr/proto"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// PullPolicyParameter is the backend parameter that sets the image pull policy of a task.
+const PullPolicyParameter = "pull_policy"
+
+// ImageDigestMetadata is the task log metadata key of the repository digest of the task image, like ubuntu@sha256:...
+const ImageDigestMetadata = "image_digest"
+
+// BackendParameters are the task resources backend parameters supported by RNNR.
+var BackendParameters = []string{PullPolicyParameter, NetworkParameter, WritableRootfsParameter, CapabilitiesParameter}
+
 // CreateTask creates a task with new ID and queue state.
+// It returns InvalidTask error if task can not be executed, or its image or security relaxations are not allowed.
 func (m *Main) CreateTask(t *models.Task) error {
-	switch len(t.Executors) {
-	case 0:
-		return errors.New("no executors submitted")
-	case 1:
-	default:
-		return fmt.Errorf("multiple executors not supported, got %d executors", len(t.Executors))
+	if err := validateTask(t); err != nil {
+		return &InvalidTask{err}
+	}
+	if err := m.ImagePolicy.Check(t.Executors[0].Image); err != nil {
+		return &InvalidTask{err}
+	}
+	if err := m.SecurityPolicy.Check(t.Resources); err != nil {
+		return &InvalidTask{err}
 	}
 
 	t.ID = uuid.New().String()
 	t.State = models.Queued
 	t.Logs = []*models.TaskLog{{}}
+	if t.Resources == nil {
+		t.Resources = &models.Resources{}
+	}
 	if t.Resources.CPUCores == 0 {
 		t.Resources.CPUCores = 1
 	}
+
+	// Unsupported backend parameters are not stored.
+	for key := range t.Resources.BackendParameters {
+		if !supportedBackendParameter(key) {
+			delete(t.Resources.BackendParameters, key)
+			t.Logs[0].SystemLogs = append(t.Logs[0].SystemLogs, fmt.Sprintf("backend parameter %s not supported", key))
+		}
+	}
 	return m.DB.SaveTask(t)
 }
 
+func validateTask(t *models.Task) error {
+	switch len(t.Executors) {
+	case 0:
+		return errors.New("no executors submitted")
+	case 1:
+	default:
+		return fmt.Errorf("multiple executors not supported, got %d executors", len(t.Executors))
+	}
+
+	if t.Executors[0].Image == "" {
+		return errors.New("executor image is required")
+	}
+	if len(t.Executors[0].Command) == 0 {
+		return errors.New("executor command is required")
+	}
+
+	if t.Resources != nil && t.Resources.BackendParametersStrict {
+		for key := range t.Resources.BackendParameters {
+			if !supportedBackendParameter(key) {
+				return fmt.Errorf("backend parameter %s not supported", key)
+			}
+		}
+	}
+	// Worker volumes and scratch directories are checked by workers.
+	if _, err := mounts(nil, &proto.Container{Inputs: inputs(t.Inputs), Outputs: outputs(t.Outputs)}); err != nil {
+		return err
+	}
+	if policy := backendParameter(t.Resources, PullPolicyParameter); policy != "" {
+		if _, err := ParsePullPolicy(policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backendParameter returns the value of a backend parameter (case insensitive key), or an empty string.
+func backendParameter(r *models.Resources, key string) string {
+	if r == nil {
+		return ""
+	}
+	for k, v := range r.BackendParameters {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// supportedBackendParameter returns true if key (case insensitive) is in BackendParameters.
+func supportedBackendParameter(key string) bool {
+	for _, p := range BackendParameters {
+		if strings.EqualFold(p, key) {
+			return true
+		}
+	}
+	return false
+}
+
 // GetTask returns a task by its ID.
 func (m *Main) GetTask(id string, view models.View) (*models.Task, error) {
 	t, err := m.DB.GetTask(id, view)
@@ -61,18 +148,131 @@ func (m *Main) CancelTask(id string) error {
 	if err != nil {
 		return err
 	}
-	if err := RemoteCancel(task, node); err != nil {
+	if err := m.Workers.RemoteCancel(task, node); err != nil {
 		log.WithField("error", err).Error("Unable to cancel task remotely.")
 	}
 
 	return m.DB.UpdateTask(task)
 }
 
-// ListTasks returns all tasks.
-func (m *Main) ListTasks(namePrefix string, limit int64, start int64, view models.View, nodes []string, states []models.State) (*models.ListTasksResponse, error) {
-	ts, err := m.DB.ListTasks(limit, start, view, nodes, states)
+// ListTasks returns a page of tasks that match given filter.
+// pageToken is the next page token of previous response, empty for the first page.
+// Response has a next page token if there are more tasks to be listed.
+// pageSize defaults to DefaultPageSize and is limited to MaxPageSize.
+func (m *Main) ListTasks(pageSize int64, pageToken string, view models.View, filter *models.TaskFilter) (*models.ListTasksResponse, error) {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	if pageSize > MaxPageSize {
+		pageSize = MaxPageSize
+	}
+
+	var after *PageToken
+	if pageToken != "" {
+		var err error
+		if after, err = ParsePageToken(pageToken); err != nil {
+			return nil, err
+		}
+	}
+
+	// Request one more task to know whether there is a next page.
+	ts, err := m.DB.ListTasks(pageSize+1, after, view, filter)
 	if err != nil {
 		return nil, fmt.Errorf("unable to retrieve all tasks: %w", err)
 	}
-	return &models.ListTasksResponse{Tasks: ts}, nil
+
+	if ts == nil {
+		ts = []*models.Task{}
+	}
+	resp := &models.ListTasksResponse{Tasks: ts}
+	if int64(len(ts)) > pageSize {
+		resp.Tasks = ts[:pageSize]
+		resp.NextPageToken = NewPageToken(resp.Tasks[pageSize-1]).String()
+	}
+
+	if view == models.Minimal {
+		for _, t := range resp.Tasks {
+			t.Created = nil
+		}
+	}
+	return resp, nil
+}
+
+// logsPollInterval is how often task state is checked while waiting for a task to start running.
+const logsPollInterval = time.Second
+
+// TaskLogs writes executor standard output and error of a task to stdout and stderr writers.
+// A nil writer skips that output.
+// Logs of running tasks are streamed from worker. If follow is true it keeps writing until task finishes or ctx is canceled.
+// Logs of terminated tasks are read from task executor logs.
+// If follow is true it waits for queued and initializing tasks to start.
+// tail is the number of lines from the end of logs, all lines if zero or negative.
+func (m *Main) TaskLogs(ctx context.Context, task *models.Task, follow bool, tail int, stdout, stderr io.Writer) error {
+	for task.State == models.Queued || task.State == models.Initializing {
+		if !follow {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(logsPollInterval):
+		}
+
+		var err error
+		if task, err = m.GetTask(task.ID, models.Full); err != nil {
+			return err
+		}
+	}
+
+	if task.Active() {
+		node, err := m.DB.GetNode(task.Host)
+		if err != nil {
+			return err
+		}
+		req := &proto.LogsRequest{Id: task.ID, Stdout: stdout != nil, Stderr: stderr != nil, Follow: follow, Tail: int32(tail)}
+		err = m.Workers.RemoteLogs(ctx, node.Address(), req, stdout, stderr)
+		if status.Code(err) != codes.NotFound {
+			return err
+		}
+		// Container was removed after task finished.
+		if task, err = m.GetTask(task.ID, models.Full); err != nil {
+			return err
+		}
+	}
+
+	if len(task.Logs) == 0 || len(task.Logs[0].ExecutorLogs) == 0 {
+		return nil
+	}
+	logs := task.Logs[0].ExecutorLogs[0]
+	if stdout != nil {
+		if _, err := io.WriteString(stdout, tailLines(logs.Stdout, tail)); err != nil {
+			return err
+		}
+	}
+	if stderr != nil {
+		if _, err := io.WriteString(stderr, tailLines(logs.Stderr, tail)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tailLines returns the last n lines of s, or s if n is zero or negative.
+func tailLines(s string, n int) string {
+	if n <= 0 {
+		return s
+	}
+	end := len(s)
+	if strings.HasSuffix(s, "\n") {
+		end--
+	}
+	for i := end - 1; i >= 0; i-- {
+		if s[i] == '\n' {
+			n--
+			if n == 0 {
+				return s[i+1:]
+			}
+		}
+	}
+	return s
 }
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/labbcb/rnnr/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// StateStore keeps the final state of exited containers on disk, one JSON file per container.
+// Workers report these states even if containers were removed while workers or main servers were down.
+type StateStore struct {
+	dir string
+}
+
+// NewStateStore creates a state store in dir.
+func NewStateStore(dir string) (*StateStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &StateStore{dir}, nil
+}
+
+func (s *StateStore) file(id string) string {
+	return filepath.Join(s.dir, filepath.Base(id)+".json")
+}
+
+// Save stores the state of a container.
+func (s *StateStore) Save(id string, state *proto.State) error {
+	b, err := protojson.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that a crash never leaves a partial state.
+	tmp := s.file(id) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file(id))
+}
+
+// Load returns the stored state of a container, or nil if there is none.
+func (s *StateStore) Load(id string) (*proto.State, error) {
+	b, err := ioutil.ReadFile(s.file(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state proto.State
+	if err := protojson.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Delete removes the stored state of a container.
+func (s *StateStore) Delete(id string) error {
+	if err := os.Remove(s.file(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns container IDs with stored states and when they were stored.
+func (s *StateStore) List() (map[string]time.Time, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]time.Time)
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".json") {
+			ids[strings.TrimSuffix(info.Name(), ".json")] = info.ModTime()
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// WorkerCredentials are used by main to connect to worker nodes.
+// Connections are not encrypted by default. Use ClientTLS to enable mutual TLS.
+var WorkerCredentials credentials.TransportCredentials = insecure.NewCredentials()
+
+// workerDialOption returns the transport credentials used to connect to worker nodes.
+func workerDialOption() grpc.DialOption {
+	return grpc.WithTransportCredentials(WorkerCredentials)
+}
+
+// ServerTLS loads a TLS configuration that requires clients to present a certificate signed by CA.
+func ServerTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, pool, err := loadTLS(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientTLS loads a TLS configuration that presents a client certificate and verifies servers against CA.
+func ClientTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, pool, err := loadTLS(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func loadTLS(certFile, keyFile, caFile string) (tls.Certificate, *x509.CertPool, error) {
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return tls.Certificate{}, nil, errors.New("TLS requires certificate, private key and CA certificate files")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("loading key pair: %w", err)
+	}
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	return cert, pool, nil
+}
+
+// loadCertPool reads PEM-encoded CA certificates from file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no PEM-encoded certificate found", file)
+	}
+	return pool, nil
+}
+
+// CertificateAuthority issues certificates for main and worker nodes.
+type CertificateAuthority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// NewCertificateAuthority creates a self-signed CA and writes ca.crt and ca.key files to dir.
+// Existing files are not overwritten.
+func NewCertificateAuthority(dir string, validity time.Duration) (*CertificateAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template, err := certTemplate("RNNR CA", validity)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKeyPair(dir, "ca", der, key); err != nil {
+		return nil, err
+	}
+	return &CertificateAuthority{cert, key}, nil
+}
+
+// LoadCertificateAuthority reads ca.crt and ca.key files from dir.
+func LoadCertificateAuthority(dir string) (*CertificateAuthority, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		return nil, fmt.Errorf("loading CA: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok || !cert.IsCA {
+		return nil, errors.New("loading CA: not a certificate authority created by rnnr")
+	}
+	return &CertificateAuthority{cert, key}, nil
+}
+
+// Issue creates a certificate for name valid for the given host names and IP addresses,
+// and writes name.crt and name.key files to dir.
+// Certificates are valid for both server and client authentication.
+// If hosts is empty name is used as host name.
+func (ca *CertificateAuthority) Issue(dir, name string, hosts []string, validity time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := certTemplate(name, validity)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	if len(hosts) == 0 {
+		hosts = []string{name}
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return err
+	}
+	return writeKeyPair(dir, name, der, key)
+}
+
+func certTemplate(name string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"RNNR"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+// writeKeyPair writes PEM-encoded certificate and private key to name.crt and name.key files.
+// Nothing is written if any of them exists, and the key is removed if the certificate cannot be written,
+// so a key never remains without its certificate.
+func writeKeyPair(dir, name string, der []byte, key *ecdsa.PrivateKey) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	keyFile, certFile := filepath.Join(dir, name+".key"), filepath.Join(dir, name+".crt")
+	for _, file := range []string{certFile, keyFile} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			if err == nil {
+				err = fmt.Errorf("%s already exists", file)
+			}
+			return err
+		}
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		_ = os.Remove(keyFile)
+		return err
+	}
+	return nil
+}
+
+func writePEM(file, blockType string, b []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(f, &pem.Block{Type: blockType, Bytes: b})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file)
+	}
+	return err
+}
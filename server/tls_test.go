@@ -0,0 +1,63 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertificateAuthority(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewCertificateAuthority(dir, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := LoadCertificateAuthority(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.Issue(dir, "worker1", nil, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadTLS(filepath.Join(dir, "worker1.crt"), filepath.Join(dir, "worker1.key"), filepath.Join(dir, "ca.crt")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewCertificateAuthority(dir, time.Hour); err == nil {
+		t.Error("got no error creating CA over existing one")
+	}
+	if err := ca.Issue(dir, "worker1", nil, time.Hour); err == nil {
+		t.Error("got no error issuing existing certificate")
+	}
+}
+
+func TestIssueKeepsExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := NewCertificateAuthority(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, existing := range []string{"worker1.crt", "worker2.key"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, existing), []byte("existing"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"worker1", "worker2"} {
+		if err := ca.Issue(dir, name, nil, time.Hour); err == nil {
+			t.Errorf("got no error issuing %s", name)
+		}
+	}
+
+	for _, file := range []string{"worker1.key", "worker2.crt"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); !os.IsNotExist(err) {
+			t.Errorf("%s was written", file)
+		}
+	}
+	for _, file := range []string{"worker1.crt", "worker2.key"} {
+		if b, err := ioutil.ReadFile(filepath.Join(dir, file)); err != nil || string(b) != "existing" {
+			t.Errorf("%s was changed", file)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is the unit of CPU times in /proc, which is fixed for user space.
+const clockTicks = 100
+
+// sessionUsage returns CPU time in nanoseconds and memory in bytes of processes in session sid.
+// If some process of the session runs in its own cgroup (v2), usage is read from that cgroup,
+// which also accounts processes that already exited.
+// Otherwise CPU time and resident memory of current processes are summed.
+func sessionUsage(sid int) (cpuTime, memory uint64, err error) {
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	leader := processCgroup(sid)
+	var ticks, pages uint64
+	for _, dir := range dirs {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+		if err != nil {
+			// Process exited.
+			continue
+		}
+		// Command name is between parentheses and may have spaces.
+		s := string(b)
+		fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+		if len(fields) < 22 || fields[3] != strconv.Itoa(sid) {
+			continue
+		}
+
+		if pid, _ := strconv.Atoi(filepath.Base(dir)); pid != sid {
+			if cgroup := processCgroup(pid); cgroup != "" && cgroup != leader {
+				if cpuTime, memory, err := cgroupUsage(cgroup); err == nil {
+					return cpuTime, memory, nil
+				}
+			}
+		}
+
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		rss, _ := strconv.ParseUint(fields[21], 10, 64)
+		ticks += utime + stime
+		pages += rss
+	}
+	return ticks * uint64(time.Second/clockTicks), pages * uint64(os.Getpagesize()), nil
+}
+
+// processCgroup returns the cgroup v2 path of a process, or an empty string if unknown.
+func processCgroup(pid int) string {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::")
+		}
+	}
+	return ""
+}
+
+// cgroupUsage reads CPU time in nanoseconds and memory in bytes of a cgroup v2.
+func cgroupUsage(cgroup string) (cpuTime, memory uint64, err error) {
+	dir := filepath.Join("/sys/fs/cgroup", cgroup)
+	f, err := os.Open(filepath.Join(dir, "cpu.stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 2 && fields[0] == "usage_usec" {
+			usec, _ := strconv.ParseUint(fields[1], 10, 64)
+			cpuTime = usec * uint64(time.Microsecond)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "memory.current"))
+	if err != nil {
+		return 0, 0, err
+	}
+	memory, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	return cpuTime, memory, err
+}
+
+// workerCgroup is the leaf cgroup worker moves itself to,
+// so that controllers can be enabled for container cgroups next to it.
+const workerCgroup = "rnnr-worker"
+
+// cgroupSandbox limits CPU and memory of local containers with cgroup v2.
+type cgroupSandbox struct {
+	base string
+}
+
+// newCgroupSandbox enables cpu and memory controllers in the cgroup of worker.
+// It requires cgroup v2 and write access to worker cgroup, for example as root or with systemd Delegate=yes.
+func newCgroupSandbox() (*cgroupSandbox, error) {
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		return nil, errors.New("cgroup v2 is not mounted")
+	}
+	own := processCgroup(os.Getpid())
+	if own == "" {
+		return nil, errors.New("cgroup of worker not found")
+	}
+	// Worker was already moved by a previous start.
+	if filepath.Base(own) == workerCgroup {
+		own = filepath.Dir(own)
+	}
+
+	base := filepath.Join("/sys/fs/cgroup", own)
+	leaf := filepath.Join(base, workerCgroup)
+	if err := os.MkdirAll(leaf, 0755); err != nil {
+		return nil, err
+	}
+	if err := writeCgroup(leaf, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+		return nil, err
+	}
+	if err := writeCgroup(base, "cgroup.subtree_control", "+cpu +memory"); err != nil {
+		return nil, err
+	}
+	return &cgroupSandbox{base}, nil
+}
+
+// create creates the cgroup of a container.
+// CPU and memory are limited to cpuCores and ramGb if they are greater than zero.
+func (s *cgroupSandbox) create(id string, cpuCores int32, ramGb float64) (string, error) {
+	dir := s.path(id)
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	if cpuCores > 0 {
+		if err := writeCgroup(dir, "cpu.max", fmt.Sprintf("%d 100000", cpuCores*100000)); err != nil {
+			return "", err
+		}
+	}
+	if ramGb > 0 {
+		if err := writeCgroup(dir, "memory.max", strconv.FormatUint(uint64(ramGb*1e9), 10)); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// remove removes the cgroup of a container, which must not have processes.
+func (s *cgroupSandbox) remove(id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *cgroupSandbox) path(id string) string {
+	return filepath.Join(s.base, "rnnr-"+filepath.Base(id))
+}
+
+func writeCgroup(dir, file, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+}
@@ -0,0 +1,26 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package server
+
+import "errors"
+
+// sessionUsage is not measured without /proc.
+func sessionUsage(int) (cpuTime, memory uint64, err error) {
+	return 0, 0, nil
+}
+
+// cgroupSandbox is not available without cgroups.
+type cgroupSandbox struct{}
+
+func newCgroupSandbox() (*cgroupSandbox, error) {
+	return nil, errors.New("cgroups require Linux")
+}
+
+func (s *cgroupSandbox) create(string, int32, float64) (string, error) {
+	return "", errors.New("cgroups require Linux")
+}
+
+func (s *cgroupSandbox) remove(string) error {
+	return nil
+}
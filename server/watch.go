@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/labbcb/rnnr/models"
+	"github.com/labbcb/rnnr/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// watchResync is how often tasks of watched nodes are checked in case some event was missed.
+	watchResync = time.Minute
+	// watchRetry is the time to wait before watching a node again after connection fails.
+	watchRetry = 5 * time.Second
+)
+
+// watcher receives container events of a node.
+type watcher struct {
+	address string
+	cancel  context.CancelFunc
+
+	mu sync.Mutex
+	// connected is true while worker is streaming events.
+	connected bool
+	// lastCheck is when node tasks were last checked by polling.
+	lastCheck time.Time
+}
+
+// needsCheck returns true if node tasks should be checked by polling.
+// Tasks of watched nodes are only checked every watchResync.
+func (w *watcher) needsCheck() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.connected && time.Since(w.lastCheck) < watchResync {
+		return false
+	}
+	w.lastCheck = time.Now()
+	return true
+}
+
+func (w *watcher) setConnected(connected bool) {
+	w.mu.Lock()
+	w.connected = connected
+	w.lastCheck = time.Now()
+	w.mu.Unlock()
+}
+
+// watchers keeps a watcher for each active node by host.
+type watchers struct {
+	mu    sync.Mutex
+	nodes map[string]*watcher
+}
+
+// get returns the watcher of node, or nil if node is not watched.
+func (ws *watchers) get(host string) *watcher {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.nodes[host]
+}
+
+// WatchNodes starts watching container events of active nodes and stops watching disabled nodes.
+func (m *Main) WatchNodes() error {
+	active := true
+	nodes, err := m.DB.ListNodes(&active)
+	if err != nil {
+		return err
+	}
+
+	m.watchers.mu.Lock()
+	defer m.watchers.mu.Unlock()
+	if m.watchers.nodes == nil {
+		m.watchers.nodes = make(map[string]*watcher)
+	}
+
+	hosts := make(map[string]bool)
+	for _, node := range nodes {
+		hosts[node.Host] = true
+		if w, ok := m.watchers.nodes[node.Host]; ok {
+			if w.address == node.Address() {
+				continue
+			}
+			// Node was enabled again with another address.
+			w.cancel()
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		w := &watcher{address: node.Address(), cancel: cancel}
+		m.watchers.nodes[node.Host] = w
+		go m.watchNode(ctx, w, node)
+	}
+
+	for host, w := range m.watchers.nodes {
+		if !hosts[host] {
+			w.cancel()
+			delete(m.watchers.nodes, host)
+		}
+	}
+	return nil
+}
+
+// watchNode receives container events of node until ctx is canceled.
+// It reconnects if connection fails, checking node tasks to catch up with missed events.
+func (m *Main) watchNode(ctx context.Context, w *watcher, node *models.Node) {
+	fields := log.Fields{"host": node.Host}
+	for ctx.Err() == nil {
+		err := m.Workers.Watch(ctx, node.Address(), func() {
+			log.WithFields(fields).Info("Watching node.")
+			w.setConnected(true)
+			m.checkNode(node, nil)
+			m.reconcileNode(node)
+		}, func(e *proto.Event) {
+			m.handleEvent(node, e)
+		})
+		w.setConnected(false)
+
+		switch {
+		case ctx.Err() != nil:
+		case status.Code(err) == codes.Unimplemented:
+			log.WithFields(fields).Info("Node does not stream container events, tasks will be checked by polling.")
+			return
+		default:
+			log.WithError(err).WithFields(fields).Warn("Stopped watching node, tasks will be checked by polling.")
+			select {
+			case <-ctx.Done():
+			case <-time.After(watchRetry):
+			}
+		}
+	}
+}
+
+// reconcileNode removes containers of node whose tasks are not active anymore,
+// for example tasks canceled while worker was down.
+func (m *Main) reconcileNode(node *models.Node) {
+	fields := log.Fields{"host": node.Host}
+	// Containers created after tasks were listed are kept.
+	listed := time.Now()
+	tasks, err := m.DB.ListTasks(0, nil, models.Minimal, &models.TaskFilter{Nodes: []string{node.Host}, States: models.ActiveStates()})
+	if err != nil {
+		log.WithError(err).WithFields(fields).Warn("Unable to get active tasks.")
+		return
+	}
+
+	active := make([]string, len(tasks))
+	for i, task := range tasks {
+		active[i] = task.ID
+	}
+
+	removed, err := m.Workers.RemoteReconcile(node.Address(), active, listed)
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+	case err != nil:
+		log.WithError(err).WithFields(fields).Warn("Unable to reconcile node containers.")
+	case len(removed) > 0:
+		log.WithFields(fields).WithField("removed", removed).Info("Removed containers of inactive tasks.")
+	}
+}
+
+// handleEvent updates the task of a container event.
+func (m *Main) handleEvent(node *models.Node, e *proto.Event) {
+	fields := log.Fields{"id": e.Id, "host": node.Host, "event": e.Type}
+	if e.Type == proto.Event_START {
+		log.WithFields(fields).Debug("Container started.")
+		return
+	}
+
+	// Usage and OOM events only update running tasks, so that tasks canceled or checked meanwhile are not overwritten.
+	var err error
+	switch e.Type {
+	case proto.Event_USAGE:
+		err = m.DB.UpdateRunningMetrics(e.Id, node.Host, e.State.GetCpuTime(), e.State.GetCpuPercent(), e.State.GetMemory())
+	case proto.Event_OOM:
+		log.WithFields(fields).Warn("Container ran out of memory.")
+		err = m.DB.AddRunningSystemLog(e.Id, node.Host, "Container ran out of memory.")
+	case proto.Event_EXIT:
+		task, err := m.DB.GetTask(e.Id, models.Full)
+		if err != nil {
+			log.WithError(err).WithFields(fields).Warn("Unable to get task of container event.")
+			return
+		}
+		// Task may not be running yet; it will be checked later.
+		if task.State != models.Running || task.Host != node.Host {
+			return
+		}
+		// Check gets exit code, times and logs, and removes the container.
+		m.checkNode(node, []*models.Task{task})
+		return
+	}
+	if err != nil {
+		log.WithError(err).WithFields(fields).Error("Unable to update task.")
+	}
+}
+
+// checkNode checks running tasks of node.
+// If tasks is nil all running tasks of node are checked.
+func (m *Main) checkNode(node *models.Node, tasks []*models.Task) {
+	if tasks == nil {
+		var err error
+		tasks, err = m.DB.ListTasks(0, nil, models.Full, &models.TaskFilter{Nodes: []string{node.Host}, States: []models.State{models.Running}})
+		if err != nil {
+			log.WithError(err).WithField("host", node.Host).Warn("Unable to get running tasks.")
+			return
+		}
+	}
+	if len(tasks) == 0 {
+		return
+	}
+
+	ch := make(chan *models.Task)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go m.CheckNodeTasks(tasks, node, ch, wg)
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	for task := range ch {
+		if err := m.DB.UpdateTask(task); err != nil {
+			log.WithFields(log.Fields{"id": task.ID, "name": task.Name, "error": err}).Error("Unable to update task.")
+		}
+	}
+}
@@ -2,26 +2,58 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"time"
 
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/labbcb/rnnr/proto"
 	"github.com/pbnjay/memory"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-// Worker struct wraps service info and Docker connection.
+// watchingHeader is sent by workers once they are streaming container events.
+const watchingHeader = "rnnr-watching"
+
+// usageInterval is how often usage of running containers is sent to main servers watching containers.
+const usageInterval = 10 * time.Second
+
+// reconcileGrace protects containers created shortly before main server listed its active tasks,
+// also tolerating clock differences between main server and worker.
+const reconcileGrace = 5 * time.Minute
+
+// Worker struct wraps service info and container runtime.
 type Worker struct {
 	proto.UnimplementedWorkerServer
-	Info   *proto.Info
-	Docker *Docker
+	Info    *proto.Info
+	Runtime Runtime
+	States  *StateStore
+	Images  *ImageUsage
+	// PullPolicy is used for containers without pull policy.
+	PullPolicy PullPolicy
+	// AllowedUIDs and AllowedGIDs are the users and groups that containers may run as, apart from worker user.
+	AllowedUIDs, AllowedGIDs IDRanges
+	// Scratch creates scratch directories of containers, optional.
+	Scratch *ScratchSpace
 }
 
-// NewWorker creates a Worker.
+// NewWorker creates a Worker that runs containers with rt.
 // If cpuCores or ramGb is not defined (equal to 0) it will guess the available resources.
 // It will warn if the defined values are bigger than guessed values.
-func NewWorker(cpuCores int32, ramGb float64, volumes []string, user, group string) (*Worker, error) {
-	conn, err := DockerConnect(volumes, user, group)
+// Final states of exited containers and image usage are kept in stateDir.
+func NewWorker(rt Runtime, cpuCores int32, ramGb float64, stateDir string) (*Worker, error) {
+	states, err := NewStateStore(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	images, err := NewImageUsage(filepath.Join(stateDir, "images.usage"))
 	if err != nil {
 		return nil, err
 	}
@@ -37,7 +69,10 @@ func NewWorker(cpuCores int32, ramGb float64, volumes []string, user, group stri
 	}
 
 	worker := &Worker{
-		Docker: conn,
+		Runtime:    rt,
+		States:     states,
+		Images:     images,
+		PullPolicy: PullIfNotPresent,
 		Info: &proto.Info{
 			CpuCores:           cpuCores,
 			RamGb:              ramGb,
@@ -54,41 +89,474 @@ func (w *Worker) GetInfo(context.Context, *empty.Empty) (*proto.Info, error) {
 	return w.Info, nil
 }
 
-// RunContainer starts a Docker container.
+// PullImage pulls an image according to pull policy, streaming download progress and then the image digest.
+func (w *Worker) PullImage(req *proto.PullRequest, stream proto.Worker_PullImageServer) error {
+	policy, err := w.pullPolicy(req.PullPolicy)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	fields := log.Fields{"image": req.Image, "policy": policy}
+	var sendErr error
+	digest, err := w.Runtime.Pull(stream.Context(), req.Image, policy, func(p *proto.PullProgress) {
+		if sendErr == nil {
+			sendErr = stream.Send(p)
+		}
+	})
+	if err != nil {
+		log.WithError(err).WithFields(fields).Error("Unable to pull image.")
+		return err
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+	w.touchImage(req.Image)
+	log.WithFields(fields).WithField("digest", digest).Info("Image pulled.")
+	if digest == "" {
+		return nil
+	}
+	return stream.Send(&proto.PullProgress{Status: "Digest: " + digest, Digest: digest})
+}
+
+// touchImage records that image was used, logging failures.
+func (w *Worker) touchImage(image string) {
+	if err := w.Images.Touch(image); err != nil {
+		log.WithError(err).WithField("image", image).Warn("Unable to save image usage.")
+	}
+}
+
+// ListImages lists images cached on the node.
+func (w *Worker) ListImages(ctx context.Context, _ *empty.Empty) (*proto.Images, error) {
+	_, images, err := w.images(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &proto.Images{Images: images}, nil
+}
+
+// images lists images of runtime with when worker last used them.
+func (w *Worker) images(ctx context.Context) (ImageCache, []*proto.Image, error) {
+	cache, ok := w.Runtime.(ImageCache)
+	if !ok {
+		return nil, nil, status.Error(codes.Unimplemented, "container runtime does not cache images")
+	}
+	images, err := cache.Images(ctx)
+	if err != nil {
+		log.WithError(err).Error("Unable to list images.")
+		return nil, nil, err
+	}
+	for _, image := range images {
+		if t, ok := w.Images.LastUsed(image.References); ok {
+			image.LastUsed = timestamppb.New(t)
+		}
+	}
+	return cache, images, nil
+}
+
+// PruneImages removes images used by worker that no container uses, least recently used first,
+// until images take at most the maximum size. Images unused for too long are removed regardless of size.
+func (w *Worker) PruneImages(ctx context.Context, req *proto.PruneRequest) (*proto.Pruned, error) {
+	cache, images, err := w.images(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	var unused []*proto.Image
+	for _, image := range images {
+		size += image.Size
+		if image.LastUsed != nil && !image.InUse {
+			unused = append(unused, image)
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool {
+		return unused[i].LastUsed.AsTime().Before(unused[j].LastUsed.AsTime())
+	})
+
+	pruned := &proto.Pruned{}
+	maxAge := time.Duration(req.UnusedSeconds) * time.Second
+	for _, image := range unused {
+		tooBig := req.MaxSize > 0 && size > req.MaxSize
+		tooOld := maxAge > 0 && time.Since(image.LastUsed.AsTime()) > maxAge
+		if !tooBig && !tooOld {
+			continue
+		}
+
+		fields := log.Fields{"id": image.Id, "references": image.References, "size": image.Size}
+		if err := cache.RemoveImage(ctx, image.Id); err != nil {
+			log.WithError(err).WithFields(fields).Warn("Unable to remove image.")
+			continue
+		}
+		if err := w.Images.Forget(image.References); err != nil {
+			log.WithError(err).WithFields(fields).Warn("Unable to save image usage.")
+		}
+		size -= image.Size
+		pruned.Removed = append(pruned.Removed, image)
+		pruned.Reclaimed += image.Size
+		log.WithFields(fields).Info("Image removed.")
+	}
+	return pruned, nil
+}
+
+// pullPolicy returns the named pull policy, or worker policy if name is empty.
+func (w *Worker) pullPolicy(name string) (PullPolicy, error) {
+	if name == "" {
+		return w.PullPolicy, nil
+	}
+	return ParsePullPolicy(name)
+}
+
+// RunContainer starts a container.
+// The image is pulled according to container or worker pull policy.
 func (w *Worker) RunContainer(ctx context.Context, container *proto.Container) (*empty.Empty, error) {
-	if err := w.Docker.Run(ctx, container); err != nil {
+	policy, err := w.pullPolicy(container.PullPolicy)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	container.PullPolicy = string(policy)
+	if err := w.checkUser(container.User); err != nil {
+		log.WithError(err).WithField("id", container.Id).Warn("Container user not allowed.")
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	// Main server retries containers after network errors, even if they were started.
+	_, err = w.Runtime.Check(ctx, &proto.Container{Id: container.Id})
+	if err == nil {
+		return nil, status.Errorf(codes.AlreadyExists, "container %s already exists", container.Id)
+	}
+	if _, ok := err.(*ContainerNotFound); !ok {
+		log.WithError(err).WithField("id", container.Id).Error("Unable to check container.")
+		return nil, err
+	}
+
+	// Only worker chooses host directories mounted as scratch.
+	container.Scratch = ""
+	if w.Scratch != nil {
+		dir, err := w.Scratch.Create(container.Id, container.User)
+		if err != nil {
+			log.WithError(err).WithField("id", container.Id).Error("Unable to create scratch directory.")
+			return nil, err
+		}
+		container.Scratch = dir
+	}
+
+	if err := w.Runtime.Run(ctx, container); err != nil {
 		log.WithError(err).WithFields(log.Fields{"id": container.Id, "image": container.Image}).Error("Unable to run container.")
+		// Scratch directory was created above, Create fails if it already exists.
+		if container.Scratch != "" {
+			w.Scratch.Remove(container.Id, false)
+		}
 		return nil, err
 	}
+	w.touchImage(container.Image)
 
 	log.WithFields(log.Fields{"id": container.Id, "image": container.Image}).Info("Running container.")
 	return &empty.Empty{}, nil
 }
 
+// checkUser returns an error if container user (UID:GID) is not allowed.
+func (w *Worker) checkUser(user string) error {
+	if user == "" {
+		return nil
+	}
+	uid, gid, err := parseUser(user)
+	if err != nil {
+		return err
+	}
+	if !w.AllowedUIDs.Contains(uid) {
+		return fmt.Errorf("UID %d is not allowed on this worker", uid)
+	}
+	if !w.AllowedGIDs.Contains(gid) {
+		return fmt.Errorf("GID %d is not allowed on this worker", gid)
+	}
+	return nil
+}
+
+// Recover saves states of containers that exited while worker was down.
+// They are reported to main server on the next check.
+func (w *Worker) Recover(ctx context.Context) error {
+	containers, err := w.Runtime.Managed(ctx)
+	if err != nil {
+		return err
+	}
+
+	var running int
+	for id, c := range containers {
+		if c.Running {
+			running++
+			continue
+		}
+		state, err := w.Runtime.Check(ctx, &proto.Container{Id: id})
+		if err != nil {
+			log.WithError(err).WithField("id", id).Warn("Unable to check container.")
+			continue
+		}
+		if err := w.States.Save(id, state); err != nil {
+			log.WithError(err).WithField("id", id).Warn("Unable to save container state.")
+			continue
+		}
+		log.WithFields(log.Fields{"id": id, "exitCode": state.ExitCode}).Info("Container exited while worker was down.")
+	}
+	log.WithField("running", running).Info("Recovered containers.")
+	return nil
+}
+
 // CheckContainer checks if container is running.
+// Exited containers are removed after saving their state.
+// If container was already removed its saved state is returned.
 func (w *Worker) CheckContainer(ctx context.Context, container *proto.Container) (*proto.State, error) {
-	state, err := w.Docker.Check(ctx, container)
+	state, err := w.Runtime.Check(ctx, container)
+	if _, ok := err.(*ContainerNotFound); ok {
+		if saved, loadErr := w.States.Load(container.Id); loadErr != nil {
+			log.WithError(loadErr).WithField("id", container.Id).Warn("Unable to load container state.")
+		} else if saved != nil {
+			return saved, nil
+		}
+	}
 	if err != nil {
 		log.WithError(err).WithField("id", container.Id).Error("Unable to check container.")
 		return nil, err
 	}
 
 	if state.Exited {
-		log.WithFields(log.Fields{"id": container.Id, "exitCode": state.ExitCode}).Info("Container exited.")
-		w.Docker.RemoveContainer(ctx, container.Id)
+		w.exited(ctx, container.Id, state)
 	}
 
 	return state, nil
 }
 
+// CheckContainers checks containers in a single request.
+// Exited containers are removed after saving their state.
+// Saved states are returned for containers that were already removed.
+func (w *Worker) CheckContainers(ctx context.Context, ids *proto.ContainerIds) (*proto.States, error) {
+	states, err := w.Runtime.CheckAll(ctx, ids.Ids)
+	if err != nil {
+		log.WithError(err).Error("Unable to check containers.")
+		return nil, err
+	}
+
+	for id, state := range states {
+		if state.Exited {
+			w.exited(ctx, id, state)
+		}
+	}
+
+	for _, id := range ids.Ids {
+		if _, ok := states[id]; ok {
+			continue
+		}
+		state, err := w.States.Load(id)
+		if err != nil {
+			log.WithError(err).WithField("id", id).Warn("Unable to load container state.")
+			continue
+		}
+		if state != nil {
+			states[id] = state
+		}
+	}
+
+	return &proto.States{States: states}, nil
+}
+
+// exited saves the state of an exited container and removes it.
+// Container is kept if its state could not be saved.
+func (w *Worker) exited(ctx context.Context, id string, state *proto.State) {
+	log.WithFields(log.Fields{"id": id, "exitCode": state.ExitCode}).Info("Container exited.")
+	if err := w.States.Save(id, state); err != nil {
+		log.WithError(err).WithField("id", id).Warn("Unable to save container state.")
+		return
+	}
+	w.removeContainer(ctx, id, state.ExitCode != 0)
+}
+
+// removeContainer removes a container and its scratch directory, which is kept if container failed and worker keeps them.
+func (w *Worker) removeContainer(ctx context.Context, id string, failed bool) {
+	w.Runtime.RemoveContainer(ctx, id)
+	if w.Scratch != nil {
+		w.Scratch.Remove(id, failed)
+	}
+}
+
+// Reconcile removes containers and saved states of tasks that are not active anymore.
+// Only containers created before main server listed its active tasks are removed.
+func (w *Worker) Reconcile(ctx context.Context, active *proto.ActiveTasks) (*proto.Reconciled, error) {
+	ids := make(map[string]bool)
+	for _, id := range active.Ids {
+		ids[id] = true
+	}
+	before := active.Listed.AsTime().Add(-reconcileGrace)
+
+	containers, err := w.Runtime.Managed(ctx)
+	if err != nil {
+		log.WithError(err).Error("Unable to list containers.")
+		return nil, err
+	}
+
+	var removed []string
+	for id, c := range containers {
+		if ids[id] || !c.Created.Before(before) {
+			continue
+		}
+		log.WithFields(log.Fields{"id": id, "running": c.Running}).Info("Task of container is not active.")
+		w.removeContainer(ctx, id, false)
+		removed = append(removed, id)
+	}
+	if w.Scratch != nil {
+		w.Scratch.Clean(ids, before)
+	}
+
+	saved, err := w.States.List()
+	if err != nil {
+		log.WithError(err).Error("Unable to list container states.")
+		return nil, err
+	}
+	for id, modified := range saved {
+		if ids[id] || !modified.Before(before) {
+			continue
+		}
+		if err := w.States.Delete(id); err != nil {
+			log.WithError(err).WithField("id", id).Warn("Unable to delete container state.")
+		}
+	}
+
+	return &proto.Reconciled{Removed: removed}, nil
+}
+
+// WatchContainers streams events of containers managed by RNNR.
+// Containers are not removed when they exit, main server will check them.
+func (w *Worker) WatchContainers(_ *empty.Empty, stream proto.Worker_WatchContainersServer) error {
+	log.Info("Main server is watching containers.")
+	err := w.Runtime.Watch(stream.Context(), usageInterval,
+		func() error { return stream.SendHeader(metadata.Pairs(watchingHeader, "true")) },
+		stream.Send)
+	if err != nil {
+		log.WithError(err).Warn("Stopped watching containers.")
+		return err
+	}
+	log.Info("Main server stopped watching containers.")
+	return nil
+}
+
+// StreamLogs streams container standard output and error.
+func (w *Worker) StreamLogs(req *proto.LogsRequest, stream proto.Worker_StreamLogsServer) error {
+	var stdout, stderr io.Writer
+	if req.Stdout {
+		stdout = &chunkWriter{stream, proto.LogChunk_STDOUT}
+	}
+	if req.Stderr {
+		stderr = &chunkWriter{stream, proto.LogChunk_STDERR}
+	}
+
+	if err := w.Runtime.Logs(stream.Context(), req.Id, req.Follow, req.Tail, stdout, stderr); err != nil {
+		log.WithError(err).WithField("id", req.Id).Warn("Unable to stream container logs.")
+		if _, ok := err.(*ContainerNotFound); ok {
+			return status.Error(codes.NotFound, err.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+// maxChunkSize limits the size of log messages, which must be smaller than gRPC maximum message size.
+const maxChunkSize = 64 * 1024
+
+// chunkWriter sends written bytes as log chunks.
+type chunkWriter struct {
+	stream proto.Worker_StreamLogsServer
+	source proto.LogChunk_Stream
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += maxChunkSize {
+		end := i + maxChunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := c.stream.Send(&proto.LogChunk{Stream: c.source, Data: p[i:end]}); err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+// Exec executes a command in a running container with a TTY.
+// The first input message has container ID and command.
+// It returns when command exits or main server closes the stream.
+func (w *Worker) Exec(stream proto.Worker_ExecServer) error {
+	ctx := stream.Context()
+	start, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if len(start.Command) == 0 {
+		return status.Error(codes.InvalidArgument, "command is required")
+	}
+
+	fields := log.Fields{"id": start.Id, "command": start.Command}
+	session, err := w.Runtime.Exec(ctx, start.Id, start.Command, uint(start.Width), uint(start.Height))
+	if err != nil {
+		log.WithError(err).WithFields(fields).Error("Unable to execute command in container.")
+		if _, ok := err.(*ContainerNotFound); ok {
+			return status.Error(codes.NotFound, err.Error())
+		}
+		return err
+	}
+	defer session.Close()
+	log.WithFields(fields).Info("Executing command in container.")
+
+	go func() {
+		for {
+			in, err := stream.Recv()
+			if err != nil {
+				// Main server closed input or the stream.
+				if err := session.CloseInput(); err != nil {
+					log.WithError(err).WithFields(fields).Debug("Unable to close command input.")
+				}
+				return
+			}
+			if err := session.Resize(ctx, uint(in.Width), uint(in.Height)); err != nil {
+				log.WithError(err).WithFields(fields).Warn("Unable to resize terminal.")
+			}
+			if len(in.Stdin) > 0 {
+				if _, err := session.Write(in.Stdin); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := session.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&proto.ExecOutput{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	exitCode, err := session.ExitCode(ctx)
+	if err != nil {
+		return err
+	}
+	log.WithFields(fields).WithField("exitCode", exitCode).Info("Command exited.")
+	return stream.Send(&proto.ExecOutput{Exited: true, ExitCode: int32(exitCode)})
+}
+
 // StopContainer stops and removes container.
 func (w *Worker) StopContainer(ctx context.Context, container *proto.Container) (*empty.Empty, error) {
-	if err := w.Docker.Stop(ctx, container.Id); err != nil {
+	if err := w.Runtime.Stop(ctx, container.Id); err != nil {
 		log.WithError(err).WithField("id", container.Id).Error("Unable to stop container.")
 		return nil, err
 	}
 
 	log.WithField("id", container.Id).Info("Container stopped.")
-	w.Docker.RemoveContainer(ctx, container.Id)
+	w.removeContainer(ctx, container.Id, false)
 	return &empty.Empty{}, nil
 }
@@ -0,0 +1,26 @@
+package server
+
+import "testing"
+
+func TestCheckUser(t *testing.T) {
+	w := &Worker{AllowedUIDs: IDRanges{{1000, 1999}}, AllowedGIDs: IDRanges{{100, 100}}}
+	tests := []struct {
+		user string
+		fail bool
+	}{
+		{user: ""},
+		{user: "1000:100"},
+		{user: "1999:100"},
+		{user: "1000", fail: true},
+		{user: "0:100", fail: true},
+		{user: "1000:0", fail: true},
+		{user: "1000:101", fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			if err := w.checkUser(tt.user); (err != nil) != tt.fail {
+				t.Errorf("got error %v, want failure %t", err, tt.fail)
+			}
+		})
+	}
+}